@@ -0,0 +1,153 @@
+package zmemif
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket
+// activation
+const listenFdsStart = 3
+
+// ErrNoActivationFd is returned by NewSocketFromActivation if no
+// matching listener was passed to the process
+var ErrNoActivationFd = errors.New("no socket activation listener")
+
+// activationFd is a listener inherited from the service manager
+type activationFd struct {
+	fd   int
+	name string
+	used bool
+}
+
+var activation struct {
+	once sync.Once
+	mu   sync.Mutex
+	fds  []*activationFd
+}
+
+// activationFds parses LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES once.
+// The variables are unset afterwards, so that they are not inherited by
+// child processes.
+func activationFds() []*activationFd {
+	activation.once.Do(func() {
+		defer func() {
+			os.Unsetenv("LISTEN_PID")
+			os.Unsetenv("LISTEN_FDS")
+			os.Unsetenv("LISTEN_FDNAMES")
+		}()
+
+		pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		if err != nil || pid != os.Getpid() {
+			return
+		}
+		nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || nfds <= 0 {
+			return
+		}
+		var names []string
+		if s := os.Getenv("LISTEN_FDNAMES"); s != "" {
+			names = strings.Split(s, ":")
+		}
+
+		for i := 0; i < nfds; i++ {
+			fd := listenFdsStart + i
+			syscall.CloseOnExec(fd)
+			afd := &activationFd{fd: fd}
+			if i < len(names) {
+				afd.name = names[i]
+			}
+			activation.fds = append(activation.fds, afd)
+		}
+	})
+	return activation.fds
+}
+
+// NewSocketFromActivation returns a new Socket listening on a file
+// descriptor passed by systemd socket activation (LISTEN_FDS). name selects
+// the descriptor by its LISTEN_FDNAMES entry (FileDescriptorName= in the
+// socket unit), an empty name selects the first descriptor not used yet.
+// The descriptor must be a listening AF_UNIX SOCK_SEQPACKET socket. Each
+// descriptor can be used by one Socket only, and the socket file is left
+// in place when the Socket is closed.
+func NewSocketFromActivation(appName string, name string, opts ...SocketOption) (*Socket, error) {
+	fds := activationFds()
+
+	activation.mu.Lock()
+	defer activation.mu.Unlock()
+
+	var afd *activationFd
+	for _, f := range fds {
+		if !f.used && (name == "" || f.name == name) {
+			afd = f
+			break
+		}
+	}
+	if afd == nil {
+		if name == "" {
+			return nil, ErrNoActivationFd
+		}
+		return nil, fmt.Errorf("%w: %s", ErrNoActivationFd, name)
+	}
+
+	filename, err := checkListenerFd(afd.fd)
+	if err != nil {
+		return nil, fmt.Errorf("activation fd %d (%s): %v", afd.fd, afd.name, err)
+	}
+
+	socket, err := NewSocket(appName, filename, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	socket.mu.Lock()
+	err = socket.AddListener(afd.fd)
+	socket.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	afd.used = true
+
+	return socket, nil
+}
+
+// checkListenerFd verifies that fd is a listening memif socket and
+// returns the address it is bound to
+func checkListenerFd(fd int) (string, error) {
+	domain, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_DOMAIN)
+	if err != nil {
+		return "", err
+	}
+	if domain != syscall.AF_UNIX {
+		return "", fmt.Errorf("not a UNIX domain socket")
+	}
+	typ, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return "", err
+	}
+	if typ != syscall.SOCK_SEQPACKET {
+		return "", fmt.Errorf("not a SOCK_SEQPACKET socket")
+	}
+	listening, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+	if err != nil {
+		return "", err
+	}
+	if listening == 0 {
+		return "", fmt.Errorf("socket is not listening")
+	}
+
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return "", err
+	}
+	usa, ok := sa.(*syscall.SockaddrUnix)
+	if !ok || usa.Name == "" {
+		return "", fmt.Errorf("socket is not bound to an address")
+	}
+	return usa.Name, nil
+}
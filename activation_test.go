@@ -0,0 +1,137 @@
+package zmemif
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// activationChildEnv selects the checks TestActivationChild runs in the
+// child process started by TestActivation
+const activationChildEnv = "ZMEMIF_TEST_ACTIVATION"
+
+// TestActivationChild runs in a child process started like a systemd
+// service: fd 3 is a datagram socket named "dgram", fd 4 a memif listener
+// named "memif". It is skipped when run directly.
+func TestActivationChild(t *testing.T) {
+	mode := os.Getenv(activationChildEnv)
+	if mode == "" {
+		t.Skip("run by TestActivation")
+	}
+	file := os.Getenv("ZMEMIF_TEST_SOCKET")
+
+	if mode == "foreign" {
+		// LISTEN_PID names another process, the fds are not ours
+		_, err := NewSocketFromActivation("srv", "memif")
+		if !errors.Is(err, ErrNoActivationFd) {
+			t.Fatalf("activation fds of another process used: %v", err)
+		}
+		return
+	}
+
+	_, err := NewSocketFromActivation("srv", "dgram")
+	if err == nil || errors.Is(err, ErrNoActivationFd) {
+		t.Fatalf("datagram socket: %v", err)
+	}
+	_, err = NewSocketFromActivation("srv", "unknown")
+	if !errors.Is(err, ErrNoActivationFd) {
+		t.Fatalf("unknown name: %v", err)
+	}
+	for _, env := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if _, ok := os.LookupEnv(env); ok {
+			t.Fatalf("%s not unset", env)
+		}
+	}
+
+	srv, err := NewSocketFromActivation("srv", "memif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(srv)
+	if srv.GetFilename() != file {
+		t.Fatalf("socket file %q, want %q", srv.GetFilename(), file)
+	}
+	_, err = NewSocketFromActivation("srv", "memif")
+	if !errors.Is(err, ErrNoActivationFd) {
+		t.Fatalf("listener used twice: %v", err)
+	}
+
+	_, err = NewPort(srv, &PortCfg{Id: 0, Name: "srv", IsServer: true, ConnectedFunc: nopConnected}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.StartPolling()
+	cli, err := NewSocket("cli", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(cli)
+	cp, err := NewPort(cli, &PortCfg{Id: 0, Name: "cli", ConnectedFunc: nopConnected}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.StartPolling()
+	waitFor(t, "client connected", cp.IsConnected)
+
+	closeSocket(t, cli)
+	closeSocket(t, srv)
+	// the service manager owns the socket file
+	_, err = os.Stat(file)
+	if err != nil {
+		t.Fatalf("socket file removed: %v", err)
+	}
+}
+
+// TestActivation passes a datagram socket and a memif listener to a child
+// process through LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES
+func TestActivation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "memif.sock")
+	lfd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := os.NewFile(uintptr(lfd), "memif")
+	defer listener.Close()
+	err = syscall.Bind(lfd, &syscall.SockaddrUnix{Name: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Listen(lfd, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dfd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgram := os.NewFile(uintptr(dfd), "dgram")
+	defer dgram.Close()
+
+	for _, tc := range []struct {
+		mode string
+		pid  string
+	}{
+		// LISTEN_PID must be the pid of the child, the shell sets it
+		// before replacing itself with the test binary
+		{"activated", "$$"},
+		{"foreign", "1"},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			cmd := exec.Command("sh", "-c", `LISTEN_PID=`+tc.pid+` exec "$0" "$@"`,
+				os.Args[0], "-test.run", "^TestActivationChild$", "-test.v")
+			cmd.Env = append(os.Environ(),
+				activationChildEnv+"="+tc.mode,
+				"ZMEMIF_TEST_SOCKET="+file,
+				"LISTEN_FDS=2",
+				"LISTEN_FDNAMES=dgram:memif")
+			cmd.ExtraFiles = []*os.File{dgram, listener}
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatalf("%v\n%s", err, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package zmemif
+
+import "fmt"
+
+// ringBytes returns the size of a ring header followed by its descriptors
+func ringBytes(log2Size int) int {
+	return ringSize + descSize<<log2Size
+}
+
+// checkRingBounds verifies that a ring received from the peer lies
+// within a memory region added by the peer
+func (p *Port) checkRingBounds(region int, offset int, log2Size int) error {
+	if log2Size < 0 || log2Size > maxLog2RingSize {
+		return fmt.Errorf("%w: log2 ring size %d not within 0 to %d", ErrProtocol, log2Size, maxLog2RingSize)
+	}
+	if region < 0 || region >= len(p.regions) {
+		return fmt.Errorf("%w: ring in unknown memory region %d", ErrProtocol, region)
+	}
+	if offset < 0 || uint64(offset)+uint64(ringBytes(log2Size)) > p.regions[region].size {
+		return fmt.Errorf("%w: ring at offset %d exceeds memory region %d of %d bytes",
+			ErrProtocol, offset, region, p.regions[region].size)
+	}
+	return nil
+}
+
+// checkDesc verifies that length bytes of the buffer referenced by desc
+// lie within a mapped memory region. Descriptors live in shared memory,
+// so the peer may have written anything into them.
+func (q *Queue) checkDesc(desc descBuf, length int) error {
+	region := desc.getRegion()
+	if region >= len(q.port.regions) {
+		return q.invalidDesc(fmt.Errorf("%w: unknown memory region %d", ErrInvalidDescriptor, region))
+	}
+	offset := desc.getOffset()
+	if offset+length > len(q.port.regions[region].data) {
+		return q.invalidDesc(fmt.Errorf("%w: buffer at offset %d length %d exceeds memory region %d of %d bytes",
+			ErrInvalidDescriptor, offset, length, region, len(q.port.regions[region].data)))
+	}
+	return nil
+}
+
+// checkSlots verifies that the number of slots derived from the ring
+// head and tail does not exceed the ring size
+func (q *Queue) checkSlots(nSlots uint16) error {
+	if int(nSlots) > q.ring.size {
+		return q.invalidDesc(fmt.Errorf("%w: %d slots on ring of size %d", ErrInvalidDescriptor, nSlots, q.ring.size))
+	}
+	return nil
+}
+
+// invalidDesc counts err and disconnects the port if configured by
+// PortCfg.DisconnectOnInvalidDescriptor
+func (q *Queue) invalidDesc(err error) error {
+	q.port.invalidDescs.Add(1)
+	if q.port.cfg.DisconnectOnInvalidDescriptor {
+		q.port.disconnectInvalid(err)
+	}
+	return err
+}
+
+// InvalidDescriptors returns the number of descriptors and ring
+// positions found out of bounds since the port was created. It is safe
+// to call from any goroutine.
+func (p *Port) InvalidDescriptors() uint64 {
+	return p.invalidDescs.Load()
+}
+
+// disconnectInvalid disconnects the port after the peer corrupted shared
+// memory. It is called by port workers, so the disconnect runs in its
+// own goroutine as it waits for the workers to stop. Only the session
+// the error was detected in is disconnected, and only once.
+func (p *Port) disconnectInvalid(reason error) {
+	session := p.session.Load()
+	if p.invalidSess.Swap(session) == session {
+		return
+	}
+
+	go func() {
+		p.socket.mu.Lock()
+		defer p.socket.mu.Unlock()
+
+		if p.cc == nil || p.session.Load() != session {
+			return
+		}
+		p.socket.logger.Warn("disconnecting port, peer corrupted shared memory", p.logArgs("error", reason)...)
+		err := p.cc.close(true, fmt.Errorf("%w: %w", ErrProtocol, reason))
+		if err != nil {
+			p.socket.reportError(fmt.Errorf("failed to disconnect port %s: %w", p.cfg.Name, err))
+		}
+	}()
+}
@@ -0,0 +1,157 @@
+package zmemif
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/zartbot/zmemif/controlmsg"
+)
+
+// TestRingBounds adds rings outside of the peers memory region, the
+// server must disconnect instead of mapping them
+func TestRingBounds(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "memif.sock")
+	srv, err := NewSocket("srv", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(srv)
+	defer closeSocket(t, srv)
+	_, err = NewPort(srv, &PortCfg{Id: 0, Name: "srv", IsServer: true, ConnectedFunc: nopConnected}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.StartPolling()
+
+	const regionSize = 4096
+	for _, addRing := range []controlmsg.AddRing{
+		{Region: 1, RingSizeLog2: 4},
+		{Offset: regionSize - memifRingDesc, RingSizeLog2: 4},
+		{Offset: 0xffffffff, RingSizeLog2: 4},
+		{Flags: controlmsg.AddRingFlagS2M, RingSizeLog2: 10},
+	} {
+		r := dialRaw(t, file)
+		r.send(&controlmsg.Init{Version: controlmsg.Version}, -1)
+		r.expect(controlmsg.TypeAck)
+		fd, _ := sharedMemory(t, regionSize)
+		r.send(&controlmsg.AddRegion{Size: regionSize}, fd)
+		r.expect(controlmsg.TypeAck)
+		efd, err := eventFd()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.send(&addRing, efd)
+		syscall.Close(efd)
+		r.expect(controlmsg.TypeDisconnect)
+		r.close()
+	}
+}
+
+// TestHostilePeerDescriptors connects a peer writing garbage into its
+// descriptors and ring heads while the server reads and writes packets.
+// The garbage must be counted as invalid descriptors, never panic.
+func TestHostilePeerDescriptors(t *testing.T) {
+	for _, disconnect := range []bool{false, true} {
+		t.Run(map[bool]string{false: "count", true: "disconnect"}[disconnect], func(t *testing.T) {
+			testHostilePeerDescriptors(t, disconnect)
+		})
+	}
+}
+
+func testHostilePeerDescriptors(t *testing.T, disconnect bool) {
+	file := filepath.Join(t.TempDir(), "memif.sock")
+	srv, err := NewSocket("srv", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(srv)
+	defer closeSocket(t, srv)
+
+	peer := make(chan *layoutPeer, 1)
+	result := make(chan int, 1)
+	sp, err := NewPort(srv, &PortCfg{Id: 0, Name: "srv", IsServer: true, DisconnectOnInvalidDescriptor: disconnect,
+		ConnectedFunc: func(p *Port) error {
+			p.Wg.Add(1)
+			go func() {
+				defer p.Wg.Done()
+				result <- corruptPeer(p, <-peer)
+			}()
+			return nil
+		}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.StartPolling()
+
+	lp := newLayoutPeer(dialRaw(t, file), libmemifLayout(1, 1))
+	peer <- lp
+	lp.connect()
+
+	var invalid int
+	select {
+	case invalid = <-result:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out")
+	}
+	if invalid == 0 || sp.InvalidDescriptors() < uint64(invalid) {
+		t.Fatalf("%d invalid descriptor errors returned, %d counted", invalid, sp.InvalidDescriptors())
+	}
+	if !disconnect {
+		if !sp.IsConnected() {
+			t.Fatalf("port disconnected: %v", sp.DisconnectReason())
+		}
+		return
+	}
+	waitFor(t, "port disconnected", func() bool { return !sp.IsConnected() })
+	if !errors.Is(sp.DisconnectReason(), ErrInvalidDescriptor) {
+		t.Fatalf("disconnect reason %v", sp.DisconnectReason())
+	}
+	lp.expect(controlmsg.TypeDisconnect)
+}
+
+// corruptPeer randomly overwrites the descriptors and ring heads of lp
+// while reading and writing packets on the first queues of p. It returns
+// the number of ErrInvalidDescriptor errors, once the port is told to
+// quit or after a fixed number of rounds.
+func corruptPeer(p *Port, lp *layoutPeer) (invalid int) {
+	rq, err := p.GetRxQueue(0)
+	if err != nil {
+		return 0
+	}
+	tq, err := p.GetTxQueue(0)
+	if err != nil {
+		return 0
+	}
+	rng := rand.New(rand.NewSource(1))
+	buf := make([]byte, memifBufferSize)
+	pkt := make([]byte, 2*memifBufferSize)
+	count := func(err error) {
+		if errors.Is(err, ErrInvalidDescriptor) {
+			invalid++
+		}
+	}
+	for i := 0; i < 20000; i++ {
+		select {
+		case <-p.QuitChan:
+			return invalid
+		default:
+		}
+		for _, rt := range []ringType{ringTypeS2M, ringTypeM2S} {
+			d := lp.desc(rt, 0, rng.Intn(1<<memifLog2RingSize))
+			rng.Read(d[rng.Intn(memifDescSize):][:1])
+			if rng.Intn(4) == 0 {
+				binary.LittleEndian.PutUint16(lp.ring(rt, 0)[memifRingHead:], uint16(rng.Intn(1<<16)))
+			}
+		}
+		_, err = rq.ReadPacket(buf)
+		count(err)
+		_, err = tq.WritePacket(pkt[:rng.Intn(len(pkt))])
+		count(err)
+	}
+	return invalid
+}
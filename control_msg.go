@@ -1,114 +1,83 @@
 package zmemif
 
 import (
-	"bytes"
-	"container/list"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"os"
 	"syscall"
+	"time"
 	"unsafe"
+
+	"github.com/zartbot/zmemif/controlmsg"
 )
 
-const maxEpollEvents = 1
+const maxEpollEvents = 64
 const maxControlLen = 256
 const errorFdNotFound = "fd not found"
 
 const cookie = 0x3E31F20
 
 // VersionMajor is memif protocols major version
-const VersionMajor = 2
+const VersionMajor = controlmsg.VersionMajor
 
 // VersionMinor is memif protocols minor version
-const VersionMinor = 0
+const VersionMinor = controlmsg.VersionMinor
 
 // Version is memif protocols version as uint16
 // (M-Major m-minor: MMMMMMMMmmmmmmmm)
-const Version = ((VersionMajor << 8) | VersionMinor)
+const Version = controlmsg.Version
 
-type msgType uint16
+type msgType = controlmsg.Type
 
 const (
-	msgTypeNone msgType = iota
-	msgTypeAck
-	msgTypeHello
-	msgTypeInit
-	msgTypeAddRegion
-	msgTypeAddRing
-	msgTypeConnect
-	msgTypeConnected
-	msgTypeDisconnect
+	msgTypeNone       = controlmsg.TypeNone
+	msgTypeAck        = controlmsg.TypeAck
+	msgTypeHello      = controlmsg.TypeHello
+	msgTypeInit       = controlmsg.TypeInit
+	msgTypeAddRegion  = controlmsg.TypeAddRegion
+	msgTypeAddRing    = controlmsg.TypeAddRing
+	msgTypeConnect    = controlmsg.TypeConnect
+	msgTypeConnected  = controlmsg.TypeConnected
+	msgTypeDisconnect = controlmsg.TypeDisconnect
+	// msgTypeKeepalive is a zmemif extension, it is only sent to peers
+	// advertising featureKeepalive
+	msgTypeKeepalive = controlmsg.TypeKeepalive
 )
 
-const msgSize = 128
-const msgTypeSize = 2
-const msgAddRingFlagS2M = (1 << 0)
-
-type MsgHello struct {
-	// app name
-	Name            [32]byte
-	VersionMin      uint16
-	VersionMax      uint16
-	MaxRegion       uint16
-	MaxRingM2S      uint16
-	MaxRingS2M      uint16
-	MaxLog2RingSize uint8
-}
-
-type MsgInit struct {
-	Version uint16
-	Id      uint32
-	Mode    portMode
-	Secret  [24]byte
-	// app name
-	Name [32]byte
-}
-
-type MsgAddRegion struct {
-	Index uint16
-	Size  uint64
-}
-
-type MsgAddRing struct {
-	Flags          uint16
-	Index          uint16
-	Region         uint16
-	Offset         uint32
-	RingSizeLog2   uint8
-	PrivateHdrSize uint16
-}
-
-type MsgConnect struct {
-	// interface name
-	Name [32]byte
-}
-
-type MsgConnected struct {
-	// interface name
-	Name [32]byte
-}
-
-type MsgDisconnect struct {
-	Code   uint32
-	String [96]byte
-}
+const msgSize = controlmsg.Size
+const msgAddRingFlagS2M = controlmsg.AddRingFlagS2M
+
+// Control messages, see package controlmsg for their encoding
+type (
+	MsgHello      = controlmsg.Hello
+	MsgInit       = controlmsg.Init
+	MsgAddRegion  = controlmsg.AddRegion
+	MsgAddRing    = controlmsg.AddRing
+	MsgConnect    = controlmsg.Connect
+	MsgConnected  = controlmsg.Connected
+	MsgDisconnect = controlmsg.Disconnect
+)
 
 // controlMsg represents a message used in communication between memif peers
 type controlMsg struct {
-	Buffer *bytes.Buffer
-	Fd     int
+	Msg     controlmsg.Message
+	Fd      int
+	Data    []byte
+	Control []byte
 }
 
 // listener represents a listener functionality of UNIX domain socket
 type listener struct {
 	socket *Socket
 	event  syscall.EpollEvent
+	closed bool
 }
 
 // controlChannel represents a communication channel between memif peers
 // backed by UNIX domain socket
 type controlChannel struct {
-	listRef     *list.Element
 	socket      *Socket
 	port        *Port
 	event       syscall.EpollEvent
@@ -117,6 +86,19 @@ type controlChannel struct {
 	controlLen  int
 	msgQueue    []controlMsg
 	isConnected bool
+	closed      bool
+	peerCred    *PeerCred
+	// accepted is set once an inbound connection passed the listeners
+	// checks, such channels count against ListenerLimits
+	accepted bool
+	// peerFeatures are the zmemif extension features of the peer
+	peerFeatures uint32
+	// lastRx is the time the last message was received
+	lastRx time.Time
+	// handshake timers, phase identifies the message awaited, see setPhase
+	handshakeTimer *time.Timer
+	phaseTimer     *time.Timer
+	phase          uint64
 }
 
 // sendMsg sends a control message from contorl channels message queue
@@ -130,7 +112,7 @@ func (cc *controlChannel) sendMsg() (err error) {
 	cc.msgQueue = cc.msgQueue[1:]
 
 	iov := &syscall.Iovec{
-		Base: &msg.Buffer.Bytes()[0],
+		Base: &msg.Data[0],
 		Len:  msgSize,
 	}
 
@@ -139,17 +121,17 @@ func (cc *controlChannel) sendMsg() (err error) {
 		Iovlen: 1,
 	}
 
-	if msg.Fd > 0 {
-		oob := syscall.UnixRights(msg.Fd)
-		msgh.Control = &oob[0]
-		msgh.Controllen = uint64(syscall.CmsgSpace(4))
+	if len(msg.Control) > 0 {
+		msgh.Control = &msg.Control[0]
+		msgh.Controllen = uint64(len(msg.Control))
 	}
 
 	_, _, errno := syscall.Syscall(syscall.SYS_SENDMSG, uintptr(cc.event.Fd), uintptr(unsafe.Pointer(&msgh)), uintptr(0))
 	if errno != 0 {
 		os.NewSyscallError("sendmsg", errno)
-		return fmt.Errorf("SYS_SENDMSG: %s", errno)
+		return fmt.Errorf("SYS_SENDMSG: %w", errno)
 	}
+	cc.trace(TraceSent, msg.Msg, msg.Fd)
 
 	return nil
 }
@@ -176,15 +158,40 @@ func (l *listener) handleEvent(event *syscall.EpollEvent) error {
 
 	// read message
 	if (event.Events & syscall.EPOLLIN) == syscall.EPOLLIN {
-		newFd, _, err := syscall.Accept(int(l.event.Fd))
+		newFd, _, err := syscall.Accept4(int(l.event.Fd), syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC)
 		if err != nil {
+			if err == syscall.EAGAIN {
+				// stale event, connection was already accepted
+				return nil
+			}
 			return fmt.Errorf("accept: %s", err)
 		}
 
 		cc, err := l.socket.addControlChannel(newFd, nil)
 		if err != nil {
+			syscall.Close(newFd)
 			return fmt.Errorf("failed to add control channel: %s", err)
 		}
+		l.socket.logger.Debug("accepted control connection", cc.logArgs(cc.peerCredLogArgs()...)...)
+
+		if l.socket.peerCredPolicy != nil {
+			err = cc.checkPeerCred(l.socket.peerCredPolicy, nil)
+			if err != nil {
+				// rejection is reported by checkPeerCred
+				return cc.close(true, err)
+			}
+		}
+
+		err = cc.checkLimits()
+		if err != nil {
+			l.socket.logger.Warn("peer rejected", cc.logArgs(cc.peerCredLogArgs("error", err)...)...)
+			l.socket.emit(Event{Type: EventPeerRejected, PeerCred: cc.peerCred, Err: err})
+			return cc.close(true, err)
+		}
+		cc.accepted = true
+		l.socket.listenerStats.accepted.Add(1)
+
+		cc.startHandshake()
 
 		err = cc.msgEnqHello()
 		if err != nil {
@@ -207,52 +214,83 @@ func (cc *controlChannel) handleEvent(event *syscall.EpollEvent) error {
 	var size int
 	var err error
 
+	// a pending message is handled before hang up, the peer may have
+	// sent a disconnect message right before closing the socket
+	if (event.Events & syscall.EPOLLIN) == syscall.EPOLLIN {
+		size, cc.controlLen, _, _, err = syscall.Recvmsg(int(cc.event.Fd), cc.data[:], cc.control[:], 0)
+		if err != nil && err != syscall.EAGAIN {
+			return fmt.Errorf("recvmsg: %s", err)
+		}
+		if err == nil && size > 0 {
+			cc.lastRx = time.Now()
+
+			err = cc.parseMsg(cc.data[:size])
+			if err != nil {
+				return err
+			}
+
+			err = cc.sendMsg()
+			if err != nil {
+				return err
+			}
+
+			return nil
+		}
+		if err == nil && size == 0 {
+			// end of stream
+			event.Events |= syscall.EPOLLHUP
+		}
+	}
+
 	// hang up
 	if (event.Events & syscall.EPOLLHUP) == syscall.EPOLLHUP {
 		// close cc, don't send msg
-		err := cc.close(false, "")
+		err := cc.close(false, newDisconnectError(ErrPeerHangUp, true))
 		if err != nil {
 			return fmt.Errorf("failed to close control channel after hang up event: %v", err)
 		}
-		return fmt.Errorf("hang up: %v", cc.port.GetName())
+		return fmt.Errorf("hang up: %v", cc.name())
 	}
 
 	if (event.Events & syscall.EPOLLERR) == syscall.EPOLLERR {
 		// close cc, don't send msg
-		err := cc.close(false, "")
+		err := cc.close(false, newDisconnectError(ErrPeerHangUp, true))
 		if err != nil {
 			return fmt.Errorf("failed to close control channel after receiving an error event: %v", err)
 		}
-		return fmt.Errorf("received error event on control channel %v", cc.port.GetName())
+		return fmt.Errorf("received error event on control channel %v", cc.name())
 	}
 
 	if (event.Events & syscall.EPOLLIN) == syscall.EPOLLIN {
-		size, cc.controlLen, _, _, err = syscall.Recvmsg(int(cc.event.Fd), cc.data[:], cc.control[:], 0)
-		if err != nil {
-			return fmt.Errorf("recvmsg: %s", err)
-		}
-		if size != msgSize {
-			return fmt.Errorf("invalid message size %d", size)
-		}
-
-		err = cc.parseMsg()
-		if err != nil {
-			return err
-		}
-
-		err = cc.sendMsg()
-		if err != nil {
-			return err
-		}
-
+		// stale event, message was already received
 		return nil
 	}
 
 	return fmt.Errorf("unexpected event: %v", event.Events)
 }
 
+// name returns the name of the port assigned to the control channel,
+// or the channels fd if no port is assigned yet
+func (cc *controlChannel) name() string {
+	if cc.port != nil {
+		return cc.port.GetName()
+	}
+	return fmt.Sprintf("fd %d", cc.event.Fd)
+}
+
+// isClosed returns true if the listener is closed
+func (l *listener) isClosed() bool {
+	return l.closed
+}
+
+// isClosed returns true if the control channel is closed
+func (cc *controlChannel) isClosed() bool {
+	return cc.closed
+}
+
 // close closes the listener
 func (l *listener) close() error {
+	l.closed = true
 	err := l.socket.delEvent(&l.event)
 	if err != nil {
 		return fmt.Errorf("failed to del event: %v", err)
@@ -265,36 +303,59 @@ func (l *listener) close() error {
 }
 
 // close closes a control channel, if the control channel is assigned an
-// interface, the interface is disconnected
-func (cc *controlChannel) close(sendMsg bool, str string) (err error) {
+// interface, the interface is disconnected. reason is sent to the peer
+// if sendMsg is true and is reported by Port.DisconnectReason.
+func (cc *controlChannel) close(sendMsg bool, reason error) (err error) {
+	return cc.closeContext(context.Background(), sendMsg, reason)
+}
+
+// closeContext closes a control channel like close, ctx bounds the time
+// spent waiting for port workers to stop
+func (cc *controlChannel) closeContext(ctx context.Context, sendMsg bool, reason error) (err error) {
+	var errs []error
+
+	cc.closed = true
+	cc.stopHandshake()
+	dcErr := newDisconnectError(reason, false)
 	if sendMsg {
 		// first clear message queue so that the disconnect
 		// message is the only message in queue
 		cc.msgQueue = []controlMsg{}
-		cc.msgEnqDisconnect(str)
+		cc.msgEnqDisconnect(dcErr)
 
 		err = cc.sendMsg()
-		if err != nil {
-			return err
+		if err != nil && !peerGone(err) {
+			errs = append(errs, fmt.Errorf("failed to send disconnect: %v", err))
 		}
 	}
 
 	err = cc.socket.delEvent(&cc.event)
 	if err != nil {
-		return fmt.Errorf("failed to del event: %v", err)
+		errs = append(errs, fmt.Errorf("failed to del event: %v", err))
 	}
 
 	// remove referance form socket
-	cc.socket.ccList.Remove(cc.listRef)
+	delete(cc.socket.ccs, cc.event.Fd)
+
+	err = syscall.Close(int(cc.event.Fd))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to close socket: %v", err))
+	}
 
 	if cc.port != nil {
-		err = cc.port.disconnect()
+		err = cc.port.disconnect(ctx, dcErr)
 		if err != nil {
-			return fmt.Errorf("port Disconnect: %v", err)
+			errs = append(errs, fmt.Errorf("port Disconnect: %w", err))
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
+}
+
+// peerGone returns true if sending failed because the peer closed the
+// control channel, the peer needs no disconnect message then
+func peerGone(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
 }
 
 // AddListener adds a lisntener to the socket. The fd must describe a
@@ -310,7 +371,7 @@ func (socket *Socket) AddListener(fd int) (err error) {
 		Events: syscall.EPOLLIN | syscall.EPOLLERR | syscall.EPOLLHUP,
 		Fd:     int32(fd),
 	}
-	err = socket.addEvent(&l.event)
+	err = socket.addEvent(&l.event, l)
 	if err != nil {
 		return fmt.Errorf("failed to add event: %v", err)
 	}
@@ -323,8 +384,13 @@ func (socket *Socket) AddListener(fd int) (err error) {
 // addListener creates new UNIX domain socket, binds it to the address
 // and marks it as listener
 func (socket *Socket) addListener() (err error) {
+	err = socket.prepareSocketFile()
+	if err != nil {
+		return err
+	}
+
 	// create socket
-	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
 	if err != nil {
 		return fmt.Errorf("failed to create UNIX domain socket")
 	}
@@ -333,21 +399,37 @@ func (socket *Socket) addListener() (err error) {
 	// Bind to address and start listening
 	err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1)
 	if err != nil {
+		syscall.Close(fd)
 		return fmt.Errorf("failed to set socket option %s : %v", socket.filename, err)
 	}
 	err = syscall.Bind(fd, usa)
 	if err != nil {
+		syscall.Close(fd)
 		return fmt.Errorf("failed to bind socket %s : %v", socket.filename, err)
 	}
-	err = syscall.Listen(fd, syscall.SOMAXCONN)
+	err = socket.applySocketFileCfg()
+	if err == nil {
+		err = syscall.Listen(fd, syscall.SOMAXCONN)
+		if err != nil {
+			err = fmt.Errorf("failed to listen on socket %s : %v", socket.filename, err)
+		}
+	}
+	if err == nil {
+		err = socket.AddListener(fd)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to listen on socket %s : %v", socket.filename, err)
+		syscall.Close(fd)
+		if !isAbstract(socket.filename) {
+			os.Remove(socket.filename)
+		}
+		return err
 	}
+	socket.ownsFile = !isAbstract(socket.filename)
 
-	return socket.AddListener(fd)
+	return nil
 }
 
-//addControlChannel returns a new controlChannel and adds it to the socket
+// addControlChannel returns a new controlChannel and adds it to the socket
 func (socket *Socket) addControlChannel(fd int, p *Port) (*controlChannel, error) {
 	cc := &controlChannel{
 		socket:      socket,
@@ -361,137 +443,156 @@ func (socket *Socket) addControlChannel(fd int, p *Port) (*controlChannel, error
 		Events: syscall.EPOLLIN | syscall.EPOLLERR | syscall.EPOLLHUP,
 		Fd:     int32(fd),
 	}
-	err = socket.addEvent(&cc.event)
+
+	cc.peerCred, err = readPeerCred(fd)
+	if err != nil {
+		socket.logger.Warn("failed to read peer credentials", cc.logArgs("error", err)...)
+	}
+
+	err = socket.addEvent(&cc.event, cc)
 	if err != nil {
 		return nil, fmt.Errorf("failed to add event: %v", err)
 	}
 
-	cc.listRef = socket.ccList.PushBack(cc)
+	socket.ccs[cc.event.Fd] = cc
 
 	return cc, nil
 }
 
-func (cc *controlChannel) msgEnqAck() (err error) {
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, msgTypeAck)
-
-	msg := controlMsg{
-		Buffer: buf,
-		Fd:     -1,
-	}
-
-	cc.msgQueue = append(cc.msgQueue, msg)
-
+// msgEnq encodes msg and appends it to the message queue, fd is attached
+// to the message if it is not -1
+func (cc *controlChannel) msgEnq(msg controlmsg.Message, fd int) error {
+	data, control, err := controlmsg.Encode(msg, fd)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", msg.Type(), err)
+	}
+	cc.msgQueue = append(cc.msgQueue, controlMsg{
+		Msg:     msg,
+		Fd:      fd,
+		Data:    data,
+		Control: control,
+	})
 	return nil
 }
 
+func (cc *controlChannel) msgEnqAck() (err error) {
+	return cc.msgEnq(&controlmsg.Ack{}, -1)
+}
+
 func (cc *controlChannel) msgEnqHello() (err error) {
 	hello := MsgHello{
-		VersionMin:      Version,
-		VersionMax:      Version,
-		MaxRegion:       255,
-		MaxRingM2S:      255,
-		MaxRingS2M:      255,
-		MaxLog2RingSize: 14,
+		VersionMin: Version,
+		VersionMax: Version,
+		Features:   localFeatures,
 	}
+	cc.socket.negotiationPolicy.hello(&hello)
 
 	copy(hello.Name[:], []byte(cc.socket.appName))
 
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, msgTypeHello)
-	binary.Write(buf, binary.LittleEndian, hello)
-
-	msg := controlMsg{
-		Buffer: buf,
-		Fd:     -1,
-	}
-
-	cc.msgQueue = append(cc.msgQueue, msg)
-
-	return nil
+	return cc.msgEnq(&hello, -1)
 }
 
-func (cc *controlChannel) parseHello() (err error) {
-	var hello MsgHello
-
-	buf := bytes.NewReader(cc.data[msgTypeSize:])
-	err = binary.Read(buf, binary.LittleEndian, &hello)
-	if err != nil {
-		return
-	}
-
+func (cc *controlChannel) parseHello(hello *MsgHello) (err error) {
 	if hello.VersionMin > Version || hello.VersionMax < Version {
-		return fmt.Errorf("incompatible memif version")
+		return fmt.Errorf("%w: peer supports %#x-%#x", ErrVersionMismatch, hello.VersionMin, hello.VersionMax)
 	}
 
+	cc.port.peerLimits = PeerLimits{
+		MaxRegions:      int(hello.MaxRegion) + 1,
+		MaxRingsS2M:     int(hello.MaxRingS2M) + 1,
+		MaxRingsM2S:     int(hello.MaxRingM2S) + 1,
+		MaxLog2RingSize: hello.MaxLog2RingSize,
+	}
 	cc.port.run = cc.port.cfg.MemoryConfig
 
-	cc.port.run.NumQueuePairs = min16(cc.port.cfg.MemoryConfig.NumQueuePairs, hello.MaxRingS2M)
-	cc.port.run.NumQueuePairs = min16(cc.port.cfg.MemoryConfig.NumQueuePairs, hello.MaxRingM2S)
+	// client tx queues are S2M rings, rx queues are M2S rings
+	cc.port.run.NumTxQueues = min16(cc.port.cfg.MemoryConfig.NumTxQueues, ringCount(hello.MaxRingS2M))
+	cc.port.run.NumRxQueues = min16(cc.port.cfg.MemoryConfig.NumRxQueues, ringCount(hello.MaxRingM2S))
+	cc.port.run.NumQueuePairs = min16(cc.port.run.NumTxQueues, cc.port.run.NumRxQueues)
 	cc.port.run.Log2RingSize = min8(cc.port.cfg.MemoryConfig.Log2RingSize, hello.MaxLog2RingSize)
 
-	cc.port.remoteName = string(hello.Name[:])
+	cc.port.remoteName = controlmsg.String(hello.Name[:])
+	cc.peerFeatures = hello.Features
 
 	return nil
 }
 
 func (cc *controlChannel) msgEnqInit() (err error) {
 	init := MsgInit{
-		Version: Version,
-		Id:      cc.port.cfg.Id,
-		Mode:    portModeEthernet,
+		Version:  Version,
+		Id:       cc.port.cfg.Id,
+		Mode:     PortModeEthernet,
+		Secret:   cc.port.cfg.Secret,
+		Features: localFeatures,
 	}
 
 	copy(init.Name[:], []byte(cc.socket.appName))
-
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, msgTypeInit)
-	binary.Write(buf, binary.LittleEndian, init)
-
-	msg := controlMsg{
-		Buffer: buf,
-		Fd:     -1,
+	if cc.port.cfg.RemotePortName != "" {
+		init.Id = PortIdAny
+		copy(init.PortName[:], []byte(cc.port.cfg.RemotePortName))
 	}
 
-	cc.msgQueue = append(cc.msgQueue, msg)
-
-	return nil
+	return cc.msgEnq(&init, -1)
 }
 
-func (cc *controlChannel) parseInit() (err error) {
-	var init MsgInit
+func (cc *controlChannel) parseInit(init *MsgInit) (err error) {
+	if init.Version != Version {
+		return fmt.Errorf("%w: peer driver version %#x", ErrVersionMismatch, init.Version)
+	}
 
-	buf := bytes.NewReader(cc.data[msgTypeSize:])
-	err = binary.Read(buf, binary.LittleEndian, &init)
-	if err != nil {
-		return
+	// find peer port
+	port, ok := cc.socket.ports[portKey{id: init.Id, isServer: true}]
+	if ok && (port.cc != nil || port.callback) {
+		return fmt.Errorf("%w: %d", ErrUnknownPortID, init.Id)
+	}
+	if !ok && init.Id == PortIdAny && init.PortName[0] != 0 {
+		port, err = cc.socket.findPortByName(controlmsg.String(init.PortName[:]))
+		if err != nil {
+			return err
+		}
+	} else if !ok {
+		port, err = cc.socket.createPort(&PortRequest{
+			Id:       init.Id,
+			Name:     controlmsg.String(init.Name[:]),
+			Mode:     init.Mode,
+			PeerCred: cc.peerCred,
+		})
+		if err != nil {
+			return err
+		}
 	}
 
-	if init.Version != Version {
-		return fmt.Errorf("incompatible memif driver version")
+	err = cc.verifyPort(port, init.Secret)
+	if err != nil {
+		if port.autoDelete {
+			port.delete()
+		}
+		return err
 	}
+	// interface is assigned to control channel
+	port.cc = cc
+	port.peerCred.Store(cc.peerCred)
+	port.setLinkState(linkStateConnecting)
+	cc.port = port
+	cc.port.run = cc.port.cfg.MemoryConfig
+	cc.port.remoteName = controlmsg.String(init.Name[:])
+	cc.peerFeatures = init.Features
 
-	// find peer port
-	for elt := cc.socket.portList.Front(); elt != nil; elt = elt.Next() {
-		port, ok := elt.Value.(*Port)
-		if ok {
-			if port.cfg.Id == init.Id && port.cfg.IsServer && port.cc == nil {
-				// verify secret
-				if port.cfg.Secret != init.Secret {
-					return fmt.Errorf("invalid secret")
-				}
-				// interface is assigned to control channel
-				port.cc = cc
-				cc.port = port
-				cc.port.run = cc.port.cfg.MemoryConfig
-				cc.port.remoteName = string(init.Name[:])
+	return nil
+}
 
-				return nil
-			}
+// verifyPort checks that the peer may connect to port
+func (cc *controlChannel) verifyPort(port *Port, secret [24]byte) error {
+	// verify peer credentials
+	if port.cfg.PeerCredPolicy != nil {
+		err := cc.checkPeerCred(port.cfg.PeerCredPolicy, port)
+		if err != nil {
+			return err
 		}
 	}
 
-	return fmt.Errorf("invalid interface id")
+	// verify secret
+	return port.verifySecret(secret)
 }
 
 func (cc *controlChannel) msgEnqAddRegion(regionIndex uint16) (err error) {
@@ -504,36 +605,23 @@ func (cc *controlChannel) msgEnqAddRegion(regionIndex uint16) (err error) {
 		Size:  cc.port.regions[regionIndex].size,
 	}
 
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, msgTypeAddRegion)
-	binary.Write(buf, binary.LittleEndian, addRegion)
-
-	msg := controlMsg{
-		Buffer: buf,
-		Fd:     cc.port.regions[regionIndex].fd,
-	}
-
-	cc.msgQueue = append(cc.msgQueue, msg)
-
-	return nil
+	return cc.msgEnq(&addRegion, cc.port.regions[regionIndex].fd)
 }
 
-func (cc *controlChannel) parseAddRegion() (err error) {
-	var addRegion MsgAddRegion
-
-	buf := bytes.NewReader(cc.data[msgTypeSize:])
-	err = binary.Read(buf, binary.LittleEndian, &addRegion)
-	if err != nil {
-		return
+func (cc *controlChannel) parseAddRegion(addRegion *MsgAddRegion, fd int) (err error) {
+	if int(addRegion.Index) != len(cc.port.regions) {
+		syscall.Close(fd)
+		return fmt.Errorf("%w: invalid memory region index %d", ErrProtocol, addRegion.Index)
 	}
-
-	fd, err := cc.parseControlMsg()
+	err = cc.port.checkRegion(addRegion.Index, addRegion.Size)
 	if err != nil {
-		return fmt.Errorf("parseControlMsg: %s", err)
+		syscall.Close(fd)
+		return err
 	}
-
-	if addRegion.Index > 255 {
-		return fmt.Errorf("invalid memory region index")
+	err = cc.port.checkRegionFd(fd, addRegion.Size)
+	if err != nil {
+		syscall.Close(fd)
+		return err
 	}
 
 	region := memoryRegion{
@@ -566,50 +654,47 @@ func (cc *controlChannel) msgEnqAddRing(ringType ringType, ringIndex uint16) (er
 		PrivateHdrSize: 0,
 	}
 
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, msgTypeAddRing)
-	binary.Write(buf, binary.LittleEndian, addRing)
-
-	msg := controlMsg{
-		Buffer: buf,
-		Fd:     q.interruptFd,
-	}
-
-	cc.msgQueue = append(cc.msgQueue, msg)
-
-	return nil
+	return cc.msgEnq(&addRing, q.interruptFd)
 }
 
-func (cc *controlChannel) parseAddRing() (err error) {
-	var addRing MsgAddRing
-
-	buf := bytes.NewReader(cc.data[msgTypeSize:])
-	err = binary.Read(buf, binary.LittleEndian, &addRing)
-	if err != nil {
-		return
+func (cc *controlChannel) parseAddRing(addRing *MsgAddRing, fd int) (err error) {
+	// server rx queues are S2M rings, tx queues are M2S rings
+	rt := ringTypeM2S
+	if (addRing.Flags & msgAddRingFlagS2M) == msgAddRingFlagS2M {
+		rt = ringTypeS2M
 	}
-
-	fd, err := cc.parseControlMsg()
+	// the client picks the ring counts within the limits advertised in
+	// Hello, connect derives the servers queue counts from the rings
+	err = cc.port.checkRing(rt, addRing.Index, addRing.RingSizeLog2)
 	if err != nil {
+		syscall.Close(fd)
 		return err
 	}
-
-	if addRing.Index >= cc.port.run.NumQueuePairs {
-		return fmt.Errorf("invalid ring index")
+	err = cc.port.checkRingBounds(int(addRing.Region), int(addRing.Offset), int(addRing.RingSizeLog2))
+	if err != nil {
+		syscall.Close(fd)
+		return err
 	}
 
 	q := Queue{
 		port:        cc.port,
 		interruptFd: fd,
+		ring:        newRing(int(addRing.Region), rt, int(addRing.Offset), int(addRing.RingSizeLog2)),
 	}
 
-	if (addRing.Flags & msgAddRingFlagS2M) == msgAddRingFlagS2M {
-		q.ring = newRing(int(addRing.Region), ringTypeS2M, int(addRing.Offset), int(addRing.RingSizeLog2))
-		cc.port.rxQueues = append(cc.port.rxQueues, q)
-	} else {
-		q.ring = newRing(int(addRing.Region), ringTypeM2S, int(addRing.Offset), int(addRing.RingSizeLog2))
-		cc.port.txQueues = append(cc.port.txQueues, q)
+	// rings may be added in any order, the queue index is the ring index
+	queues := &cc.port.txQueues
+	if rt == ringTypeS2M {
+		queues = &cc.port.rxQueues
 	}
+	for len(*queues) <= int(addRing.Index) {
+		*queues = append(*queues, Queue{interruptFd: -1})
+	}
+	if (*queues)[addRing.Index].ring != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("%w: duplicate ring index %d", ErrProtocol, addRing.Index)
+	}
+	(*queues)[addRing.Index] = q
 
 	return nil
 }
@@ -618,37 +703,20 @@ func (cc *controlChannel) msgEnqConnect() (err error) {
 	var connect MsgConnect
 	copy(connect.Name[:], []byte(cc.port.cfg.Name))
 
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, msgTypeConnect)
-	binary.Write(buf, binary.LittleEndian, connect)
-
-	msg := controlMsg{
-		Buffer: buf,
-		Fd:     -1,
-	}
-
-	cc.msgQueue = append(cc.msgQueue, msg)
-
-	return nil
+	return cc.msgEnq(&connect, -1)
 }
 
-func (cc *controlChannel) parseConnect() (err error) {
-	var connect MsgConnect
+func (cc *controlChannel) parseConnect(connect *MsgConnect) (err error) {
+	cc.port.peerName = controlmsg.String(connect.Name[:])
 
-	buf := bytes.NewReader(cc.data[msgTypeSize:])
-	err = binary.Read(buf, binary.LittleEndian, &connect)
-	if err != nil {
-		return
-	}
-
-	cc.port.peerName = string(connect.Name[:])
-
-	err = cc.port.connect()
+	err = cc.port.connect(false)
 	if err != nil {
 		return err
 	}
 
 	cc.isConnected = true
+	cc.stopHandshake()
+	cc.port.setLinkState(linkStateUp)
 
 	return nil
 }
@@ -657,72 +725,46 @@ func (cc *controlChannel) msgEnqConnected() (err error) {
 	var connected MsgConnected
 	copy(connected.Name[:], []byte(cc.port.cfg.Name))
 
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, msgTypeConnected)
-	binary.Write(buf, binary.LittleEndian, connected)
-
-	msg := controlMsg{
-		Buffer: buf,
-		Fd:     -1,
-	}
-
-	cc.msgQueue = append(cc.msgQueue, msg)
-
-	return nil
+	return cc.msgEnq(&connected, -1)
 }
 
-func (cc *controlChannel) parseConnected() (err error) {
-	var conn MsgConnected
-
-	buf := bytes.NewReader(cc.data[msgTypeSize:])
-	err = binary.Read(buf, binary.LittleEndian, &conn)
-	if err != nil {
-		return
-	}
-
-	cc.port.peerName = string(conn.Name[:])
+func (cc *controlChannel) parseConnected(conn *MsgConnected) (err error) {
+	cc.port.peerName = controlmsg.String(conn.Name[:])
 
-	err = cc.port.connect()
+	err = cc.port.connect(false)
 	if err != nil {
 		return err
 	}
 
 	cc.isConnected = true
+	cc.stopHandshake()
+	cc.port.setLinkState(linkStateUp)
 
 	return nil
 }
 
-func (cc *controlChannel) msgEnqDisconnect(str string) (err error) {
+func (cc *controlChannel) msgEnqDisconnect(dcErr *DisconnectError) (err error) {
 	dc := MsgDisconnect{
-		// not implemented
-		Code: 0,
+		Code: uint32(dcErr.Code),
 	}
-	copy(dc.String[:], str)
+	copy(dc.String[:], dcErr.Reason)
 
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, msgTypeDisconnect)
-	binary.Write(buf, binary.LittleEndian, dc)
-
-	msg := controlMsg{
-		Buffer: buf,
-		Fd:     -1,
-	}
-
-	cc.msgQueue = append(cc.msgQueue, msg)
-
-	return nil
+	return cc.msgEnq(&dc, -1)
 }
 
-func (cc *controlChannel) parseDisconnect() (err error) {
-	var dc MsgDisconnect
-
-	buf := bytes.NewReader(cc.data[msgTypeSize:])
-	err = binary.Read(buf, binary.LittleEndian, &dc)
-	if err != nil {
-		return
+func (cc *controlChannel) parseDisconnect(dc *MsgDisconnect) (err error) {
+	dcErr := &DisconnectError{
+		Reason: controlmsg.String(dc.String[:]),
+		Remote: true,
+	}
+	// other implementations give the code a meaning of their own
+	if cc.peerFeatures&featureDisconnectCodes != 0 {
+		dcErr.Code = DisconnectCode(dc.Code)
+	} else {
+		dcErr.PeerCode = dc.Code
 	}
 
-	err = cc.close(false, string(dc.String[:]))
+	err = cc.close(false, dcErr)
 	if err != nil {
 		return fmt.Errorf("failed to disconnect control channel: %v", err)
 	}
@@ -730,18 +772,41 @@ func (cc *controlChannel) parseDisconnect() (err error) {
 	return nil
 }
 
-func (cc *controlChannel) parseMsg() error {
+// parseMsg decodes and handles a received message, data holds the
+// message and cc.control the control messages received with it
+func (cc *controlChannel) parseMsg(data []byte) error {
 	var msgType msgType
+	var msg controlmsg.Message
+	var fd int
 	var err error
 
-	buf := bytes.NewReader(cc.data[:])
-	binary.Read(buf, binary.LittleEndian, &msgType)
+	msg, fd, err = controlmsg.Decode(data, cc.control[:cc.controlLen])
+	if err != nil {
+		if len(data) >= controlmsg.TypeSize {
+			msgType = controlmsg.Type(binary.LittleEndian.Uint16(data))
+		}
+		cc.traceInvalid(data, err)
+		err = fmt.Errorf("%w: %w", ErrProtocol, err)
+		goto error
+	}
+	msgType = msg.Type()
+	cc.trace(TraceReceived, msg, fd)
+
+	cc.socket.logger.Debug("received control message", cc.logArgs("msg_type", msgType)...)
+
+	err = cc.checkMsgType(msgType)
+	if err != nil {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+		goto error
+	}
 
 	if msgType == msgTypeAck {
 		return nil
 	} else if msgType == msgTypeHello {
 		// Configure
-		err = cc.parseHello()
+		err = cc.parseHello(msg.(*MsgHello))
 		if err != nil {
 			goto error
 		}
@@ -765,13 +830,13 @@ func (cc *controlChannel) parseMsg() error {
 				goto error
 			}
 		}
-		for i := 0; uint16(i) < cc.port.run.NumQueuePairs; i++ {
+		for i := 0; uint16(i) < cc.port.run.NumTxQueues; i++ {
 			err = cc.msgEnqAddRing(ringTypeS2M, uint16(i))
 			if err != nil {
 				goto error
 			}
 		}
-		for i := 0; uint16(i) < cc.port.run.NumQueuePairs; i++ {
+		for i := 0; uint16(i) < cc.port.run.NumRxQueues; i++ {
 			err = cc.msgEnqAddRing(ringTypeM2S, uint16(i))
 			if err != nil {
 				goto error
@@ -781,18 +846,20 @@ func (cc *controlChannel) parseMsg() error {
 		if err != nil {
 			goto error
 		}
+		cc.setPhase(msgTypeConnected, cc.socket.handshakeTimeouts.connect())
 	} else if msgType == msgTypeInit {
-		err = cc.parseInit()
+		err = cc.parseInit(msg.(*MsgInit))
 		if err != nil {
 			goto error
 		}
+		cc.setPhase(msgTypeConnect, cc.socket.handshakeTimeouts.connect())
 
 		err = cc.msgEnqAck()
 		if err != nil {
 			goto error
 		}
 	} else if msgType == msgTypeAddRegion {
-		err = cc.parseAddRegion()
+		err = cc.parseAddRegion(msg.(*MsgAddRegion), fd)
 		if err != nil {
 			goto error
 		}
@@ -802,7 +869,7 @@ func (cc *controlChannel) parseMsg() error {
 			goto error
 		}
 	} else if msgType == msgTypeAddRing {
-		err = cc.parseAddRing()
+		err = cc.parseAddRing(msg.(*MsgAddRing), fd)
 		if err != nil {
 			goto error
 		}
@@ -812,7 +879,7 @@ func (cc *controlChannel) parseMsg() error {
 			goto error
 		}
 	} else if msgType == msgTypeConnect {
-		err = cc.parseConnect()
+		err = cc.parseConnect(msg.(*MsgConnect))
 		if err != nil {
 			goto error
 		}
@@ -822,66 +889,67 @@ func (cc *controlChannel) parseMsg() error {
 			goto error
 		}
 	} else if msgType == msgTypeConnected {
-		err = cc.parseConnected()
+		err = cc.parseConnected(msg.(*MsgConnected))
 		if err != nil {
 			goto error
 		}
 	} else if msgType == msgTypeDisconnect {
-		err = cc.parseDisconnect()
+		err = cc.parseDisconnect(msg.(*MsgDisconnect))
+		if err != nil {
+			goto error
+		}
+	} else if msgType == msgTypeKeepalive {
+		err = cc.msgEnqAck()
 		if err != nil {
 			goto error
 		}
 	} else {
-		err = fmt.Errorf("unknown message %d", msgType)
+		err = fmt.Errorf("%w: unknown message %d", ErrProtocol, msgType)
 		goto error
 	}
 
 	return nil
 
 error:
-	fmt.Printf("parseMsg Error: %s\n", err)
-	err1 := cc.close(true, err.Error())
+	cc.socket.logger.Warn("control message error", cc.logArgs("msg_type", msgType, "error", err)...)
+	if cc.closed {
+		// closed while a callback ran with the socket unlocked
+		return err
+	}
+	err1 := cc.close(true, err)
 	if err1 != nil {
-		return fmt.Errorf(err.Error(), ": Failed to close control channel: ", err1)
+		return fmt.Errorf("%w: failed to close control channel: %v", err, err1)
 	}
 
 	return err
 }
 
-// parseControlMsg parses control message and returns file descriptor
-// if any
-func (cc *controlChannel) parseControlMsg() (fd int, err error) {
-	// Assert only called when we require FD
-	fd = -1
+// checkMsgType verifies that a message of type t is expected in the
+// current state of the control channel. Messages referring to the port
+// are refused on server control channels until MsgInit assigns a port.
+func (cc *controlChannel) checkMsgType(t msgType) error {
+	var ok bool
 
-	controlMsgs, err := syscall.ParseSocketControlMessage(cc.control[:cc.controlLen])
-	if err != nil {
-		return -1, fmt.Errorf("syscall.ParseSocketControlMessage: %s", err)
-	}
-
-	if len(controlMsgs) == 0 {
-		return -1, fmt.Errorf("missing control message")
-	}
-
-	for _, cmsg := range controlMsgs {
-		if cmsg.Header.Level == syscall.SOL_SOCKET {
-			if cmsg.Header.Type == syscall.SCM_RIGHTS {
-				FDs, err := syscall.ParseUnixRights(&cmsg)
-				if err != nil {
-					return -1, fmt.Errorf("syscall.ParseUnixRights: %s", err)
-				}
-				if len(FDs) == 0 {
-					continue
-				}
-				// Only expect single FD
-				fd = FDs[0]
-			}
+	switch t {
+	case msgTypeAck, msgTypeDisconnect:
+		ok = true
+	case msgTypeInit:
+		ok = cc.port == nil
+	case msgTypeHello, msgTypeConnected:
+		ok = cc.port != nil && !cc.port.cfg.IsServer && !cc.isConnected
+		if t == msgTypeHello {
+			ok = ok && len(cc.port.regions) == 0
 		}
+	case msgTypeAddRegion, msgTypeAddRing, msgTypeConnect:
+		ok = cc.port != nil && cc.port.cfg.IsServer && !cc.isConnected
+	case msgTypeKeepalive:
+		ok = cc.isConnected
+	default:
+		return fmt.Errorf("%w: unknown message %d", ErrProtocol, t)
 	}
 
-	if fd == -1 {
-		return -1, fmt.Errorf("missing file descriptor")
+	if !ok {
+		return fmt.Errorf("%w: unexpected %s message", ErrProtocol, t)
 	}
-
-	return fd, nil
+	return nil
 }
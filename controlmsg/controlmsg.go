@@ -0,0 +1,396 @@
+// Package controlmsg encodes and decodes memif control messages.
+//
+// memif peers exchange fixed size messages of Size bytes over a
+// SOCK_SEQPACKET UNIX domain socket. A message starts with its Type
+// followed by the message body, all fields are little-endian and packed
+// without padding. AddRegion carries the memory region fd and AddRing
+// the interrupt eventfd as SCM_RIGHTS control messages, other messages
+// carry no fd.
+//
+// The package only deals with single messages, it keeps no connection
+// state and can be used by tools and test peers without a zmemif Port.
+package controlmsg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// VersionMajor is memif protocols major version
+const VersionMajor = 2
+
+// VersionMinor is memif protocols minor version
+const VersionMinor = 0
+
+// Version is memif protocols version as uint16
+// (M-Major m-minor: MMMMMMMMmmmmmmmm)
+const Version = ((VersionMajor << 8) | VersionMinor)
+
+// Size is the size of every control message
+const Size = 128
+
+// TypeSize is the size of the message type preceding the message body
+const TypeSize = 2
+
+// MaxLog2RingSize is the largest ring size supported by the 16 bit ring
+// head and tail
+const MaxLog2RingSize = 15
+
+// AddRingFlagS2M marks a client to server ring in AddRing.Flags
+const AddRingFlagS2M = (1 << 0)
+
+// Errors returned by Encode and Decode
+var (
+	ErrInvalidSize  = errors.New("invalid message size")
+	ErrUnknownType  = errors.New("unknown message type")
+	ErrInvalidField = errors.New("invalid message field")
+	ErrFd           = errors.New("invalid fd attachment")
+)
+
+// Type identifies a control message
+type Type uint16
+
+const (
+	TypeNone Type = iota
+	TypeAck
+	TypeHello
+	TypeInit
+	TypeAddRegion
+	TypeAddRing
+	TypeConnect
+	TypeConnected
+	TypeDisconnect
+	// TypeKeepalive is a zmemif extension, it must only be sent to peers
+	// advertising FeatureKeepalive
+	TypeKeepalive Type = 0x7a00
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeNone:
+		return "None"
+	case TypeAck:
+		return "Ack"
+	case TypeHello:
+		return "Hello"
+	case TypeInit:
+		return "Init"
+	case TypeAddRegion:
+		return "AddRegion"
+	case TypeAddRing:
+		return "AddRing"
+	case TypeConnect:
+		return "Connect"
+	case TypeConnected:
+		return "Connected"
+	case TypeDisconnect:
+		return "Disconnect"
+	case TypeKeepalive:
+		return "Keepalive"
+	}
+	return fmt.Sprintf("Unknown(%d)", uint16(t))
+}
+
+// HasFd returns true if messages of type t carry a fd
+func (t Type) HasFd() bool {
+	return t == TypeAddRegion || t == TypeAddRing
+}
+
+// zmemif extension features advertised in Hello.Features and
+// Init.Features
+const (
+	// FeatureKeepalive peers answer Keepalive with Ack
+	FeatureKeepalive uint32 = 1 << iota
+	// FeatureDisconnectCodes peers send zmemif disconnect codes in
+	// Disconnect.Code
+	FeatureDisconnectCodes
+)
+
+// Mode is the interface mode requested by the client in Init
+type Mode uint8
+
+const (
+	ModeEthernet Mode = iota
+	ModeIp
+	ModePuntInject
+)
+
+// Message is a memif control message
+type Message interface {
+	Type() Type
+	validate() error
+}
+
+type Ack struct{}
+
+type Hello struct {
+	// app name
+	Name            [32]byte
+	VersionMin      uint16
+	VersionMax      uint16
+	MaxRegion       uint16
+	MaxRingM2S      uint16
+	MaxRingS2M      uint16
+	MaxLog2RingSize uint8
+	// zmemif extension, features supported by the server. Standard
+	// memif peers leave it zeroed.
+	Features uint32
+}
+
+type Init struct {
+	Version uint16
+	Id      uint32
+	Mode    Mode
+	Secret  [24]byte
+	// app name
+	Name [32]byte
+	// zmemif extension, name of the requested server port if Id is
+	// 0xffffffff. Standard memif peers leave it zeroed.
+	PortName [32]byte
+	// zmemif extension, features supported by the client
+	Features uint32
+}
+
+type AddRegion struct {
+	Index uint16
+	Size  uint64
+}
+
+type AddRing struct {
+	Flags          uint16
+	Index          uint16
+	Region         uint16
+	Offset         uint32
+	RingSizeLog2   uint8
+	PrivateHdrSize uint16
+}
+
+type Connect struct {
+	// interface name
+	Name [32]byte
+}
+
+type Connected struct {
+	// interface name
+	Name [32]byte
+}
+
+type Disconnect struct {
+	Code   uint32
+	String [96]byte
+}
+
+// Keepalive is a zmemif extension, see TypeKeepalive
+type Keepalive struct{}
+
+func (*Ack) Type() Type        { return TypeAck }
+func (*Hello) Type() Type      { return TypeHello }
+func (*Init) Type() Type       { return TypeInit }
+func (*AddRegion) Type() Type  { return TypeAddRegion }
+func (*AddRing) Type() Type    { return TypeAddRing }
+func (*Connect) Type() Type    { return TypeConnect }
+func (*Connected) Type() Type  { return TypeConnected }
+func (*Disconnect) Type() Type { return TypeDisconnect }
+func (*Keepalive) Type() Type  { return TypeKeepalive }
+
+func (*Ack) validate() error { return nil }
+
+func (m *Hello) validate() error {
+	if m.VersionMin > m.VersionMax {
+		return fmt.Errorf("%w: min version %#x above max version %#x", ErrInvalidField, m.VersionMin, m.VersionMax)
+	}
+	if m.MaxLog2RingSize > MaxLog2RingSize {
+		return fmt.Errorf("%w: max log2 ring size %d exceeds %d", ErrInvalidField, m.MaxLog2RingSize, MaxLog2RingSize)
+	}
+	return nil
+}
+
+func (m *Init) validate() error {
+	if m.Mode > ModePuntInject {
+		return fmt.Errorf("%w: mode %d", ErrInvalidField, m.Mode)
+	}
+	return nil
+}
+
+func (m *AddRegion) validate() error {
+	if m.Size == 0 {
+		return fmt.Errorf("%w: region size 0", ErrInvalidField)
+	}
+	return nil
+}
+
+func (m *AddRing) validate() error {
+	if m.Flags&^AddRingFlagS2M != 0 {
+		return fmt.Errorf("%w: ring flags %#x", ErrInvalidField, m.Flags)
+	}
+	if m.RingSizeLog2 > MaxLog2RingSize {
+		return fmt.Errorf("%w: log2 ring size %d exceeds %d", ErrInvalidField, m.RingSizeLog2, MaxLog2RingSize)
+	}
+	return nil
+}
+
+func (*Connect) validate() error    { return nil }
+func (*Connected) validate() error  { return nil }
+func (*Disconnect) validate() error { return nil }
+func (*Keepalive) validate() error  { return nil }
+
+// newMessage returns an empty message of type t
+func newMessage(t Type) (Message, error) {
+	switch t {
+	case TypeAck:
+		return &Ack{}, nil
+	case TypeHello:
+		return &Hello{}, nil
+	case TypeInit:
+		return &Init{}, nil
+	case TypeAddRegion:
+		return &AddRegion{}, nil
+	case TypeAddRing:
+		return &AddRing{}, nil
+	case TypeConnect:
+		return &Connect{}, nil
+	case TypeConnected:
+		return &Connected{}, nil
+	case TypeDisconnect:
+		return &Disconnect{}, nil
+	case TypeKeepalive:
+		return &Keepalive{}, nil
+	}
+	return nil, fmt.Errorf("%w: %d", ErrUnknownType, uint16(t))
+}
+
+// checkFd verifies that the presence of fd matches messages of type t
+func checkFd(t Type, fd int) error {
+	if t.HasFd() && fd < 0 {
+		return fmt.Errorf("%w: %s requires a fd", ErrFd, t)
+	}
+	if !t.HasFd() && fd >= 0 {
+		return fmt.Errorf("%w: %s carries no fd", ErrFd, t)
+	}
+	return nil
+}
+
+// Encode returns the wire representation of msg and the SCM_RIGHTS
+// control message attaching fd. fd must be a valid fd for AddRegion and
+// AddRing, and -1 for other messages, which have no control message.
+func Encode(msg Message, fd int) (b []byte, oob []byte, err error) {
+	err = checkFd(msg.Type(), fd)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err = Marshal(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if fd >= 0 {
+		oob = syscall.UnixRights(fd)
+	}
+	return b, oob, nil
+}
+
+// Marshal validates msg and returns its wire representation without the
+// fd, for example to record it in a trace
+func Marshal(msg Message) ([]byte, error) {
+	err := msg.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, Size))
+	binary.Write(buf, binary.LittleEndian, msg.Type())
+	binary.Write(buf, binary.LittleEndian, msg)
+	return buf.Bytes()[:Size], nil
+}
+
+// Decode parses a message and the control messages received with it.
+// It returns the message and the fd attached to AddRegion and AddRing,
+// or -1 for other messages. All fds received in oob are closed if an
+// error is returned.
+func Decode(b []byte, oob []byte) (msg Message, fd int, err error) {
+	fds, err := parseFds(oob)
+	defer func() {
+		if err != nil {
+			for _, fd := range fds {
+				syscall.Close(fd)
+			}
+		}
+	}()
+	if err != nil {
+		return nil, -1, err
+	}
+
+	msg, err = Unmarshal(b)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	t := msg.Type()
+	if len(fds) > 1 {
+		return nil, -1, fmt.Errorf("%w: %s carries %d fds", ErrFd, t, len(fds))
+	}
+	fd = -1
+	if len(fds) == 1 {
+		fd = fds[0]
+	}
+	err = checkFd(t, fd)
+	if err != nil {
+		return nil, -1, err
+	}
+	return msg, fd, nil
+}
+
+// Unmarshal parses and validates a message without its fd, for example
+// a message recorded by a trace
+func Unmarshal(b []byte) (Message, error) {
+	if len(b) != Size {
+		return nil, fmt.Errorf("%w: %d bytes", ErrInvalidSize, len(b))
+	}
+	msg, err := newMessage(Type(binary.LittleEndian.Uint16(b)))
+	if err != nil {
+		return nil, err
+	}
+
+	// a message body is smaller than Size, so reading it can't fail
+	binary.Read(bytes.NewReader(b[TypeSize:]), binary.LittleEndian, msg)
+
+	err = msg.validate()
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// parseFds returns all fds received in SCM_RIGHTS control messages
+func parseFds(oob []byte) (fds []int, err error) {
+	if len(oob) == 0 {
+		return nil, nil
+	}
+	cmsgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFd, err)
+	}
+	for i := range cmsgs {
+		if cmsgs[i].Header.Level != syscall.SOL_SOCKET || cmsgs[i].Header.Type != syscall.SCM_RIGHTS {
+			continue
+		}
+		rights, err := syscall.ParseUnixRights(&cmsgs[i])
+		if err != nil {
+			return fds, fmt.Errorf("%w: %v", ErrFd, err)
+		}
+		fds = append(fds, rights...)
+	}
+	return fds, nil
+}
+
+// String returns the C string stored in b
+func String(b []byte) string {
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return string(b)
+	}
+	return string(b[:i])
+}
@@ -0,0 +1,301 @@
+package controlmsg
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+// field places b at offset off of a message
+type field struct {
+	off int
+	b   []byte
+}
+
+// wire returns a message of type t with the given fields, in the layout
+// of memif.h
+func wire(t Type, fields ...field) []byte {
+	b := make([]byte, Size)
+	b[0], b[1] = byte(t), byte(t>>8)
+	for _, f := range fields {
+		copy(b[f.off:], f.b)
+	}
+	return b
+}
+
+func name(s string) [32]byte {
+	var b [32]byte
+	copy(b[:], s)
+	return b
+}
+
+// goldenMessages pairs every message type with its wire representation
+// laid out as the memif_msg_*_t structs of memif.h version 2, followed by
+// the zmemif extension fields
+var goldenMessages = []struct {
+	msg  Message
+	wire []byte
+}{
+	{&Ack{}, wire(TypeAck)},
+	{
+		&Hello{
+			Name:            name("vpp"),
+			VersionMin:      0x0200,
+			VersionMax:      0x0201,
+			MaxRegion:       0x00ff,
+			MaxRingM2S:      0x0102,
+			MaxRingS2M:      0x0304,
+			MaxLog2RingSize: 14,
+			Features:        FeatureKeepalive | 0x80000000,
+		},
+		wire(TypeHello,
+			field{2, []byte("vpp")},           // name[32]
+			field{34, []byte{0x00, 0x02}},     // min_version
+			field{36, []byte{0x01, 0x02}},     // max_version
+			field{38, []byte{0xff, 0x00}},     // max_region
+			field{40, []byte{0x02, 0x01}},     // max_m2s_ring
+			field{42, []byte{0x04, 0x03}},     // max_s2m_ring
+			field{44, []byte{14}},             // max_log2_ring_size
+			field{45, []byte{1, 0, 0, 0x80}}), // zmemif features
+	},
+	{
+		&Init{
+			Version:  0x0200,
+			Id:       0x11223344,
+			Mode:     ModeIp,
+			Secret:   [24]byte{'s', 'e', 'c', 23: 't'},
+			Name:     name("dpdk"),
+			PortName: name("port0"),
+			Features: FeatureKeepalive,
+		},
+		wire(TypeInit,
+			field{2, []byte{0x00, 0x02}},             // version
+			field{4, []byte{0x44, 0x33, 0x22, 0x11}}, // id
+			field{8, []byte{1}},                      // mode
+			field{9, []byte("sec")},                  // secret[24]
+			field{32, []byte("t")},                   // secret[23]
+			field{33, []byte("dpdk")},                // name[32]
+			field{65, []byte("port0")},               // zmemif port name[32]
+			field{97, []byte{1, 0, 0, 0}}),           // zmemif features
+	},
+	{
+		&AddRegion{Index: 0x0102, Size: 0x0102030405060708},
+		wire(TypeAddRegion,
+			field{2, []byte{0x02, 0x01}},                                      // index
+			field{4, []byte{0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01}}), // size
+	},
+	{
+		&AddRing{Flags: AddRingFlagS2M, Index: 2, Region: 3, Offset: 0x01020304, RingSizeLog2: 10, PrivateHdrSize: 0x0506},
+		wire(TypeAddRing,
+			field{2, []byte{1, 0}},                   // flags
+			field{4, []byte{2, 0}},                   // index
+			field{6, []byte{3, 0}},                   // region
+			field{8, []byte{0x04, 0x03, 0x02, 0x01}}, // offset
+			field{12, []byte{10}},                    // log2_ring_size
+			field{13, []byte{0x06, 0x05}}),           // private_hdr_size
+	},
+	{
+		&Connect{Name: name("memif0/0")},
+		wire(TypeConnect, field{2, []byte("memif0/0")}), // if_name[32]
+	},
+	{
+		&Connected{Name: name("memif1/0")},
+		wire(TypeConnected, field{2, []byte("memif1/0")}), // if_name[32]
+	},
+	{
+		&Disconnect{Code: 0x01020304, String: [96]byte{'b', 'y', 'e', 95: 'z'}},
+		wire(TypeDisconnect,
+			field{2, []byte{0x04, 0x03, 0x02, 0x01}}, // code
+			field{6, []byte("bye")},                  // string[96]
+			field{101, []byte("z")}),                 // string[95]
+	},
+	{&Keepalive{}, wire(TypeKeepalive)},
+}
+
+func TestGolden(t *testing.T) {
+	for _, tc := range goldenMessages {
+		t.Run(tc.msg.Type().String(), func(t *testing.T) {
+			b, err := Marshal(tc.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, tc.wire) {
+				t.Fatalf("marshaled\n%x\nwant\n%x", b, tc.wire)
+			}
+			msg, err := Unmarshal(tc.wire)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(msg, tc.msg) {
+				t.Fatalf("unmarshaled %+v, want %+v", msg, tc.msg)
+			}
+		})
+	}
+}
+
+func TestTypeWire(t *testing.T) {
+	for _, tc := range []struct {
+		t    Type
+		wire uint16
+	}{
+		{TypeNone, 0}, {TypeAck, 1}, {TypeHello, 2}, {TypeInit, 3}, {TypeAddRegion, 4},
+		{TypeAddRing, 5}, {TypeConnect, 6}, {TypeConnected, 7}, {TypeDisconnect, 8},
+		{TypeKeepalive, 0x7a00},
+	} {
+		if uint16(tc.t) != tc.wire {
+			t.Errorf("%s is %#x, want %#x", tc.t, uint16(tc.t), tc.wire)
+		}
+	}
+	if TypeKeepalive.String() != "Keepalive" || Type(77).String() != "Unknown(77)" {
+		t.Fatalf("type names %s %s", TypeKeepalive, Type(77))
+	}
+}
+
+// TestRoundTrip sends every message through a SOCK_SEQPACKET socket pair,
+// AddRegion and AddRing with a fd
+func TestRoundTrip(t *testing.T) {
+	sp, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(sp[0])
+	defer syscall.Close(sp[1])
+
+	var pipe [2]int
+	err = syscall.Pipe(pipe[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(pipe[0])
+	defer syscall.Close(pipe[1])
+
+	for _, tc := range goldenMessages {
+		fd := -1
+		if tc.msg.Type().HasFd() {
+			fd = pipe[0]
+		}
+		b, oob, err := Encode(tc.msg, fd)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.msg.Type(), err)
+		}
+		if (len(oob) > 0) != tc.msg.Type().HasFd() {
+			t.Fatalf("%s: control message %x", tc.msg.Type(), oob)
+		}
+		err = syscall.Sendmsg(sp[0], b, oob, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rb := make([]byte, 2*Size)
+		roob := make([]byte, syscall.CmsgSpace(4))
+		n, oobn, _, _, err := syscall.Recvmsg(sp[1], rb, roob, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, rfd, err := Decode(rb[:n], roob[:oobn])
+		if err != nil {
+			t.Fatalf("%s: %v", tc.msg.Type(), err)
+		}
+		if !reflect.DeepEqual(msg, tc.msg) {
+			t.Fatalf("decoded %+v, want %+v", msg, tc.msg)
+		}
+		if !tc.msg.Type().HasFd() {
+			if rfd != -1 {
+				t.Fatalf("%s: fd %d", tc.msg.Type(), rfd)
+			}
+			continue
+		}
+		// the received fd refers to the pipe
+		var want, got syscall.Stat_t
+		syscall.Fstat(pipe[0], &want)
+		err = syscall.Fstat(rfd, &got)
+		if err != nil || got.Ino != want.Ino {
+			t.Fatalf("%s: fd %d is not the pipe: %v", tc.msg.Type(), rfd, err)
+		}
+		syscall.Close(rfd)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		msg Message
+		fd  int
+		err error
+	}{
+		{&Hello{VersionMin: 0x0201, VersionMax: 0x0200}, -1, ErrInvalidField},
+		{&Hello{MaxLog2RingSize: 16}, -1, ErrInvalidField},
+		{&Init{Mode: ModePuntInject + 1}, -1, ErrInvalidField},
+		{&AddRegion{Size: 0}, 0, ErrInvalidField},
+		{&AddRing{Flags: 2}, 0, ErrInvalidField},
+		{&AddRing{RingSizeLog2: 16}, 0, ErrInvalidField},
+		{&AddRegion{Size: 1}, -1, ErrFd},
+		{&AddRing{}, -1, ErrFd},
+		{&Ack{}, 0, ErrFd},
+	} {
+		_, _, err := Encode(tc.msg, tc.fd)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("encode %s %+v: %v, want %v", tc.msg.Type(), tc.msg, err, tc.err)
+		}
+	}
+
+	for _, tc := range []struct {
+		b   []byte
+		err error
+	}{
+		{make([]byte, Size-1), ErrInvalidSize},
+		{make([]byte, Size+1), ErrInvalidSize},
+		{wire(TypeNone), ErrUnknownType},
+		{wire(99), ErrUnknownType},
+		{wire(TypeHello, field{34, []byte{1, 2}}), ErrInvalidField},
+		{wire(TypeAddRing, field{12, []byte{16}}), ErrInvalidField},
+		{wire(TypeAddRegion, field{4, []byte{1}}), ErrFd},
+	} {
+		_, _, err := Decode(tc.b, nil)
+		if !errors.Is(err, tc.err) {
+			t.Errorf("decode %x: %v, want %v", tc.b[:4], err, tc.err)
+		}
+	}
+}
+
+// TestDecodeClosesFds checks that fds received with invalid messages are
+// closed
+func TestDecodeClosesFds(t *testing.T) {
+	var pipe [2]int
+	err := syscall.Pipe(pipe[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(pipe[0])
+	defer syscall.Close(pipe[1])
+
+	for _, tc := range []struct {
+		b   []byte
+		fds int
+	}{
+		{wire(TypeAck), 1},
+		{wire(99), 1},
+		{wire(TypeAddRing), 2},
+		{wire(TypeAddRegion), 1},
+	} {
+		var fds []int
+		for i := 0; i < tc.fds; i++ {
+			fd, err := syscall.Dup(pipe[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			fds = append(fds, fd)
+		}
+		_, _, err := Decode(tc.b, syscall.UnixRights(fds...))
+		if err == nil {
+			t.Fatalf("decoded %x", tc.b[:4])
+		}
+		for _, fd := range fds {
+			if syscall.Fstat(fd, new(syscall.Stat_t)) == nil {
+				syscall.Close(fd)
+				t.Fatalf("decode %x: fd %d not closed", tc.b[:4], fd)
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package zmemif
+
+import (
+	"fmt"
+	"sort"
+)
+
+// PortIdAny is sent in MsgInit.Id by clients requesting a server port by
+// name, see PortCfg.RemotePortName
+const PortIdAny uint32 = 0xffffffff
+
+// PortInfo describes a port registered on a socket
+type PortInfo struct {
+	Id         uint32
+	Name       string
+	IsServer   bool
+	Connected  bool
+	Connecting bool // handshake in progress
+	PeerName   string
+}
+
+// ListPorts returns all ports registered on the socket, ordered by role
+// (servers first) and id
+func (socket *Socket) ListPorts() []PortInfo {
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+
+	ports := make([]PortInfo, 0, len(socket.ports))
+	for _, p := range socket.ports {
+		ports = append(ports, PortInfo{
+			Id:         p.cfg.Id,
+			Name:       p.cfg.Name,
+			IsServer:   p.cfg.IsServer,
+			Connected:  p.linkState.Load() == linkStateUp,
+			Connecting: p.linkState.Load() == linkStateConnecting,
+			PeerName:   p.peerName,
+		})
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].IsServer != ports[j].IsServer {
+			return ports[i].IsServer
+		}
+		return ports[i].Id < ports[j].Id
+	})
+
+	return ports
+}
+
+// findPortByName returns the free server port with the lowest id named
+// name, socket lock must be held
+func (socket *Socket) findPortByName(name string) (*Port, error) {
+	var port *Port
+	for key, p := range socket.ports {
+		if !key.isServer || p.cfg.Name != name || p.cc != nil || p.callback {
+			continue
+		}
+		if port == nil || p.cfg.Id < port.cfg.Id {
+			port = p
+		}
+	}
+	if port == nil {
+		return nil, fmt.Errorf("%w: no free port named %q", ErrUnknownPortID, name)
+	}
+	return port, nil
+}
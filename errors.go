@@ -0,0 +1,159 @@
+package zmemif
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zartbot/zmemif/controlmsg"
+)
+
+// Errors returned by port setup, the control channel and the datapath.
+// They can be matched with errors.Is, also when wrapped in a
+// DisconnectError.
+var (
+	ErrVersionMismatch      = errors.New("incompatible memif version")
+	ErrInvalidSecret        = errors.New("invalid secret")
+	ErrUnknownPortID        = errors.New("unknown port id")
+	ErrWrongCookie          = errors.New("wrong cookie")
+	ErrProtocol             = errors.New("memif protocol error")
+	ErrPeerHangUp           = errors.New("peer hung up")
+	ErrShutdown             = errors.New("port shut down")
+	ErrPeerCredDenied       = errors.New("peer credentials denied")
+	ErrLimitExceeded        = errors.New("negotiation limit exceeded")
+	ErrInvalidConfig        = errors.New("invalid port configuration")
+	ErrHugePagesUnavailable = errors.New("hugepages unavailable")
+	ErrSocketClosed         = errors.New("socket closed")
+	ErrHandover             = errors.New("port handed over to another process")
+	ErrInvalidQueue         = errors.New("invalid queue index")
+	ErrRingFull             = errors.New("ring full")
+	ErrIncompleteChain      = errors.New("incomplete chained buffer")
+	ErrInvalidDescriptor    = errors.New("invalid descriptor")
+	ErrUnsealedRegion       = errors.New("memory region not sealed")
+	ErrMemoryFault          = errors.New("shared memory fault")
+	ErrHandshakeTimeout     = errors.New("handshake timed out")
+	ErrPeerUnresponsive     = errors.New("peer unresponsive")
+	ErrConnectionLimit      = errors.New("connection limit exceeded")
+)
+
+// DisconnectCode is carried in MsgDisconnect.Code and tells the peer why
+// the control channel was closed. Other memif implementations send codes
+// of their own in the same field, a received code is only taken as a
+// DisconnectCode if the peer advertised featureDisconnectCodes.
+type DisconnectCode uint32
+
+// featureDisconnectCodes peers send DisconnectCode values in
+// MsgDisconnect.Code
+const featureDisconnectCodes = controlmsg.FeatureDisconnectCodes
+
+const (
+	DisconnectCodeNone DisconnectCode = iota
+	DisconnectCodeShutdown
+	DisconnectCodeVersionMismatch
+	DisconnectCodeInvalidSecret
+	DisconnectCodeUnknownPortID
+	DisconnectCodeWrongCookie
+	DisconnectCodeProtocolError
+	DisconnectCodePeerCredDenied
+	DisconnectCodeLimitExceeded
+	DisconnectCodeUnsealedRegion
+	DisconnectCodeHandshakeTimeout
+	DisconnectCodePeerUnresponsive
+	DisconnectCodeConnectionLimit
+)
+
+// disconnectCodeErrors maps disconnect codes to the matching sentinel error
+var disconnectCodeErrors = []struct {
+	code DisconnectCode
+	err  error
+}{
+	{DisconnectCodeShutdown, ErrShutdown},
+	{DisconnectCodeVersionMismatch, ErrVersionMismatch},
+	{DisconnectCodeInvalidSecret, ErrInvalidSecret},
+	{DisconnectCodeUnknownPortID, ErrUnknownPortID},
+	{DisconnectCodeWrongCookie, ErrWrongCookie},
+	{DisconnectCodeProtocolError, ErrProtocol},
+	{DisconnectCodePeerCredDenied, ErrPeerCredDenied},
+	{DisconnectCodeLimitExceeded, ErrLimitExceeded},
+	{DisconnectCodeUnsealedRegion, ErrUnsealedRegion},
+	{DisconnectCodeHandshakeTimeout, ErrHandshakeTimeout},
+	{DisconnectCodePeerUnresponsive, ErrPeerUnresponsive},
+	{DisconnectCodeConnectionLimit, ErrConnectionLimit},
+}
+
+func (code DisconnectCode) String() string {
+	if code == DisconnectCodeNone {
+		return "none"
+	}
+	if err := code.err(); err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("code %d", uint32(code))
+}
+
+// err returns the sentinel error associated with the code or nil
+func (code DisconnectCode) err() error {
+	for _, e := range disconnectCodeErrors {
+		if e.code == code {
+			return e.err
+		}
+	}
+	return nil
+}
+
+// disconnectCodeOf returns the disconnect code describing err
+func disconnectCodeOf(err error) DisconnectCode {
+	for _, e := range disconnectCodeErrors {
+		if errors.Is(err, e.err) {
+			return e.code
+		}
+	}
+	return DisconnectCodeNone
+}
+
+// DisconnectError describes why a control channel was closed. Remote is
+// true if the peer closed the channel, either by sending a disconnect
+// message or by hanging up. PeerCode holds the code received from a peer
+// that doesn't send DisconnectCode values, its meaning is up to the
+// peer's implementation and Code is DisconnectCodeNone.
+type DisconnectError struct {
+	Code     DisconnectCode
+	PeerCode uint32
+	Reason   string
+	Remote   bool
+	cause    error
+}
+
+// newDisconnectError wraps reason into a DisconnectError
+func newDisconnectError(reason error, remote bool) *DisconnectError {
+	var dcErr *DisconnectError
+	if errors.As(reason, &dcErr) {
+		return dcErr
+	}
+	return &DisconnectError{
+		Code:   disconnectCodeOf(reason),
+		Reason: reason.Error(),
+		Remote: remote,
+		cause:  reason,
+	}
+}
+
+func (e *DisconnectError) Error() string {
+	side := "local"
+	if e.Remote {
+		side = "remote"
+	}
+	code := e.Code.String()
+	if e.PeerCode != 0 {
+		code = fmt.Sprintf("peer code %d", e.PeerCode)
+	}
+	return fmt.Sprintf("%s disconnect (%s): %s", side, code, e.Reason)
+}
+
+// Unwrap returns the underlying cause, or for disconnects received from
+// the peer the sentinel error matching the code
+func (e *DisconnectError) Unwrap() error {
+	if e.cause != nil {
+		return e.cause
+	}
+	return e.Code.err()
+}
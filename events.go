@@ -0,0 +1,67 @@
+package zmemif
+
+import "time"
+
+// EventType identifies the kind of Event
+type EventType int
+
+const (
+	// EventPeerAccepted is emitted when a peer passes the peer credential
+	// checks, on the listener or when it attaches to a server port
+	EventPeerAccepted EventType = iota
+	// EventPeerRejected is emitted when a peer is refused, by peer
+	// credential checks or listener limits, Err holds the reason
+	EventPeerRejected
+	// EventPeerDegraded is emitted when the liveness check marks a port
+	// degraded, Err holds the reason, see LivenessConfig
+	EventPeerDegraded
+	// EventPeerRecovered is emitted when the peer of a degraded port
+	// responds again
+	EventPeerRecovered
+	// EventPeerUnresponsive is emitted right before the liveness check
+	// disconnects a port, Err holds the reason
+	EventPeerUnresponsive
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPeerAccepted:
+		return "PeerAccepted"
+	case EventPeerRejected:
+		return "PeerRejected"
+	case EventPeerDegraded:
+		return "PeerDegraded"
+	case EventPeerRecovered:
+		return "PeerRecovered"
+	case EventPeerUnresponsive:
+		return "PeerUnresponsive"
+	}
+	return "Unknown"
+}
+
+// Event reports a change on a socket or one of its ports to the
+// application, see WithEventFunc
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	Socket   *Socket
+	Port     *Port     // nil if no port is assigned to the peer yet
+	PeerCred *PeerCred // nil if the peer credentials are unknown
+	Err      error
+}
+
+// EventFunc receives socket events. It is called from the goroutine
+// handling the control channel or running the liveness check with the
+// socket locked, so it must not block or call Socket or Port methods that
+// manage connections.
+type EventFunc func(ev Event)
+
+// emit passes event to the sockets EventFunc
+func (socket *Socket) emit(ev Event) {
+	if socket.eventFunc == nil {
+		return
+	}
+	ev.Socket = socket
+	ev.Time = time.Now()
+	socket.eventFunc(ev)
+}
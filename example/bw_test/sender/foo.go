@@ -33,7 +33,7 @@ func sendpkt(p *zmemif.Port, qid int) {
 			return
 		default:
 			sendpkt := make([]byte, 64)
-			s := txq.WritePacket(sendpkt)
+			s, _ := txq.WritePacket(sendpkt)
 			if s > 0 {
 				atomic.AddUint64(data.PacketCnt, 1)
 			}
@@ -59,9 +59,9 @@ func main() {
 
 	var pktCnt uint64 = 0
 
-	ctrlSock, err := zmemif.NewSocket("foo", *socketName)
+	ctrlSock, err := zmemif.NewSocket("foo", *socketName, zmemif.WithLogger(zmemif.NewLogrusLogger(nil)))
 	if err != nil {
-		logrus.Fatal("create socket failed: %v", err)
+		logrus.Fatalf("create socket failed: %v", err)
 	}
 
 	for ifindex := uint32(0); ifindex < portNum; ifindex++ {
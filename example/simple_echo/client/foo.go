@@ -75,9 +75,9 @@ func main() {
 		ConnectedFunc: Connected,
 	}
 
-	ctrlSock, err := zmemif.NewSocket("foo", *socketName)
+	ctrlSock, err := zmemif.NewSocket("foo", *socketName, zmemif.WithLogger(zmemif.NewLogrusLogger(nil)))
 	if err != nil {
-		logrus.Fatal("create socket failed: %v", err)
+		logrus.Fatalf("create socket failed: %v", err)
 	}
 
 	defer ctrlSock.Delete()
@@ -0,0 +1,48 @@
+package zmemif
+
+import "fmt"
+
+// PortRequest describes a client connecting to a server port id that
+// doesn't exist on the socket
+type PortRequest struct {
+	Id       uint32    // port id requested by the client
+	Name     string    // client application name
+	Mode     PortMode  // interface mode requested by the client
+	PeerCred *PeerCred // credentials of the client process, nil if unknown
+}
+
+// PortFactory is called when a client requests an unknown port id. It
+// returns the configuration of the server port to create, Id and
+// IsServer are set by the socket. Returning nil or an error refuses the
+// client. Ports created by the factory are deleted when they disconnect.
+// It is called with the socket lock held and must not call Socket or
+// Port methods.
+type PortFactory func(req *PortRequest) (*PortCfg, error)
+
+// createPort creates a server port for req using the sockets
+// PortFactory
+func (socket *Socket) createPort(req *PortRequest) (*Port, error) {
+	if socket.portFactory == nil {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownPortID, req.Id)
+	}
+
+	cfg, err := socket.portFactory(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %d: %v", ErrUnknownPortID, req.Id, err)
+	}
+	if cfg == nil {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownPortID, req.Id)
+	}
+
+	c := *cfg
+	c.Id = req.Id
+	c.IsServer = true
+	p, err := socket.newPort(&c)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %d: %v", ErrUnknownPortID, req.Id, err)
+	}
+	p.autoDelete = true
+	socket.logger.Info("port created by factory", p.logArgs("remote_name", req.Name)...)
+
+	return p, nil
+}
@@ -1,5 +1,9 @@
 module github.com/zartbot/zmemif
 
-go 1.16
+// log/slog, see NewSlogLogger
+go 1.21
 
 require github.com/sirupsen/logrus v1.8.1
+
+// imported by logrus, listed since go 1.17 module graph pruning
+require golang.org/x/sys v0.0.0-20191026070338-33540a1f6037 // indirect
@@ -0,0 +1,554 @@
+package zmemif
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// handoverVersion is the version of the handover state format
+const handoverVersion = 1
+
+// handoverMaxFds is the maximum number of fds passed in a single
+// message (SCM_MAX_FD)
+const handoverMaxFds = 253
+
+// handoverMaxMsgLen is the maximum size of an encoded handover message
+const handoverMaxMsgLen = 64 << 10
+
+// handoverSocket is the first handover message, the listener fd is
+// attached to it
+type handoverSocket struct {
+	Version     int
+	Filename    string
+	OwnsFile    bool
+	HasListener bool
+	NumPorts    int
+}
+
+// handoverRegion describes a memory region of a handed over port
+type handoverRegion struct {
+	Size               uint64
+	PacketBufferOffset uint32
+}
+
+// handoverQueue describes a queue of a handed over port
+type handoverQueue struct {
+	RingType ringType
+	Region   int
+	Offset   int
+	Log2Size int
+	LastHead uint16
+	LastTail uint16
+}
+
+// handoverPort describes a connected server port. The control channel
+// fd, region fds, tx and rx queue interrupt fds are attached to the
+// message in this order.
+type handoverPort struct {
+	Id         uint32
+	Name       string
+	RemoteName string
+	PeerName   string
+	Features   uint32 // zmemif extension features of the peer
+	Run        MemoryConfig
+	Regions    []handoverRegion
+	TxQueues   []handoverQueue
+	RxQueues   []handoverQueue
+
+	fds []int
+}
+
+// numFds returns the number of fds attached to the port message
+func (hp *handoverPort) numFds() int {
+	return 1 + len(hp.Regions) + len(hp.TxQueues) + len(hp.RxQueues)
+}
+
+// close closes fds of a port that was not resumed
+func (hp *handoverPort) close() {
+	for _, fd := range hp.fds {
+		syscall.Close(fd)
+	}
+	hp.fds = nil
+}
+
+// Handover passes the listener and all connected server ports of the
+// socket to another process over conn, which must be a connected
+// "unixpacket" socket. The other process resumes them using
+// NewSocketFromHandover, peers don't notice the handover.
+//
+// Workers of the handed over ports are stopped the same way as on
+// disconnect, DisconnectedFunc is called and Port.Wg is waited for,
+// bounded by ctx. Ports whose workers don't stop in time, client ports
+// and ports still connecting are disconnected. Afterwards the socket is
+// closed, the socket file is left in place and Port.DisconnectReason
+// reports ErrHandover for handed over ports.
+func (socket *Socket) Handover(ctx context.Context, conn *net.UnixConn) error {
+	var errs []error
+
+	if socket.ownPoller {
+		err := socket.poller.Stop()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to stop poller: %v", err))
+		}
+	}
+
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+
+	if socket.closed {
+		return ErrSocketClosed
+	}
+	socket.closed = true
+
+	// stop workers of connected server ports and collect their state
+	var ports []*Port
+	var states []*handoverPort
+	for _, p := range socket.ports {
+		if !p.cfg.IsServer || p.cc == nil || !p.cc.isConnected {
+			continue
+		}
+		hp, err := p.quiesce(ctx)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if hp == nil {
+			continue
+		}
+		ports = append(ports, p)
+		states = append(states, hp)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+
+	// handed over ports are released without notifying the peer, the
+	// other process holds duplicates of all their fds
+	reason := ErrHandover
+	err := socket.sendHandover(conn, states)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("handover failed: %w", err))
+		reason = ErrShutdown
+	}
+	for _, p := range ports {
+		errs = append(errs, p.detach(reason), p.release())
+	}
+
+	if socket.listener != nil {
+		err := socket.listener.close()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		socket.listener = nil
+	}
+
+	for _, cc := range socket.ccs {
+		err := cc.closeContext(ctx, true, ErrShutdown)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, p := range socket.ports {
+		errs = append(errs, p.delete())
+	}
+
+	socket.closeHandover()
+
+	if socket.ownPoller {
+		err := socket.poller.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to close poller: %v", err))
+		}
+	}
+
+	if reason == ErrHandover {
+		socket.logger.Info("socket handed over", socket.logArgs("ports", len(ports))...)
+	}
+
+	return errors.Join(errs...)
+}
+
+// quiesce stops workers of a connected port and returns its state. The
+// port is disconnected if its workers don't stop in time, its memory is
+// left mapped in that case.
+func (p *Port) quiesce(ctx context.Context) (*handoverPort, error) {
+	var errs []error
+
+	cbErr, err := p.stopWorkers(ctx)
+	if cbErr != nil {
+		errs = append(errs, cbErr)
+	}
+	if p.pendingDc {
+		// the port was disconnected while its workers stopped
+		p.pendingDc = false
+		return nil, errors.Join(append(errs, p.releaseStopped(err))...)
+	}
+	if err != nil {
+		errs = append(errs, fmt.Errorf("port %s: workers did not stop: %w", p.cfg.Name, err))
+		return nil, errors.Join(append(errs, p.detach(ErrShutdown))...)
+	}
+
+	hp := &handoverPort{
+		Id:         p.cfg.Id,
+		Name:       p.cfg.Name,
+		RemoteName: p.remoteName,
+		PeerName:   p.peerName,
+		Features:   p.cc.peerFeatures,
+		Run:        p.run,
+		fds:        []int{int(p.cc.event.Fd)},
+	}
+	for _, r := range p.regions {
+		hp.Regions = append(hp.Regions, handoverRegion{
+			Size:               r.size,
+			PacketBufferOffset: r.packetBufferOffset,
+		})
+		hp.fds = append(hp.fds, r.fd)
+	}
+	for i := range p.txQueues {
+		hp.TxQueues = append(hp.TxQueues, p.txQueues[i].handoverState())
+		hp.fds = append(hp.fds, p.txQueues[i].interruptFd)
+	}
+	for i := range p.rxQueues {
+		hp.RxQueues = append(hp.RxQueues, p.rxQueues[i].handoverState())
+		hp.fds = append(hp.fds, p.rxQueues[i].interruptFd)
+	}
+
+	if len(hp.fds) > handoverMaxFds {
+		errs = append(errs, fmt.Errorf("port %s: too many fds to hand over: %d", p.cfg.Name, len(hp.fds)))
+		return nil, errors.Join(append(errs, p.detach(ErrShutdown), p.release())...)
+	}
+
+	return hp, errors.Join(errs...)
+}
+
+// handoverState returns the state of the queue
+func (q *Queue) handoverState() handoverQueue {
+	return handoverQueue{
+		RingType: q.ring.ringType,
+		Region:   q.ring.region,
+		Offset:   q.ring.offset,
+		Log2Size: q.ring.log2Size,
+		LastHead: q.lastHead,
+		LastTail: q.lastTail,
+	}
+}
+
+// detach closes the control channel of a port stopped by quiesce. Unlike
+// controlChannel.close it doesn't call DisconnectedFunc again and leaves
+// memory to the caller. The peer is notified unless the port was handed
+// over.
+func (p *Port) detach(reason error) error {
+	var errs []error
+
+	cc := p.cc
+	cc.closed = true
+	dcErr := newDisconnectError(reason, false)
+	if !errors.Is(reason, ErrHandover) {
+		cc.msgQueue = []controlMsg{}
+		cc.msgEnqDisconnect(dcErr)
+		err := cc.sendMsg()
+		if err != nil && !peerGone(err) {
+			errs = append(errs, fmt.Errorf("failed to send disconnect: %v", err))
+		}
+	}
+
+	err := p.socket.delEvent(&cc.event)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to del event: %v", err))
+	}
+	delete(p.socket.ccs, cc.event.Fd)
+	err = syscall.Close(int(cc.event.Fd))
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to close socket: %v", err))
+	}
+
+	p.cc = nil
+	p.stopLiveness()
+	p.setLinkState(linkStateDown)
+	p.peerCred.Store(nil)
+	p.disconnectErr.Store(dcErr)
+	p.socket.logger.Info("port disconnected", p.logArgs("reason", dcErr)...)
+
+	p.peerName = ""
+	p.remoteName = ""
+
+	return errors.Join(errs...)
+}
+
+// sendHandover sends the socket state followed by the port states
+func (socket *Socket) sendHandover(conn *net.UnixConn, ports []*handoverPort) error {
+	hs := handoverSocket{
+		Version:     handoverVersion,
+		Filename:    socket.filename,
+		OwnsFile:    socket.ownsFile,
+		HasListener: socket.listener != nil,
+		NumPorts:    len(ports),
+	}
+	var fds []int
+	if socket.listener != nil {
+		fds = append(fds, int(socket.listener.event.Fd))
+	}
+	err := sendHandoverMsg(conn, &hs, fds)
+	if err != nil {
+		return err
+	}
+
+	for _, hp := range ports {
+		err = sendHandoverMsg(conn, hp, hp.fds)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendHandoverMsg sends v encoded as JSON with fds attached
+func sendHandoverMsg(conn *net.UnixConn, v interface{}, fds []int) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(b) > handoverMaxMsgLen {
+		return fmt.Errorf("handover message too long: %d", len(b))
+	}
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+	_, _, err = conn.WriteMsgUnix(b, oob, nil)
+	return err
+}
+
+// recvHandoverMsg receives a message sent by sendHandoverMsg, decodes
+// it into v and returns the attached fds
+func recvHandoverMsg(conn *net.UnixConn, v interface{}) ([]int, error) {
+	b := make([]byte, handoverMaxMsgLen)
+	oob := make([]byte, syscall.CmsgSpace(handoverMaxFds*4))
+
+	n, oobn, flags, _, err := conn.ReadMsgUnix(b, oob)
+	if err != nil {
+		return nil, err
+	}
+
+	var fds []int
+	cmsgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, fmt.Errorf("syscall.ParseSocketControlMessage: %s", err)
+	}
+	for i := range cmsgs {
+		if cmsgs[i].Header.Level != syscall.SOL_SOCKET || cmsgs[i].Header.Type != syscall.SCM_RIGHTS {
+			continue
+		}
+		rights, err := syscall.ParseUnixRights(&cmsgs[i])
+		if err != nil {
+			closeFds(fds)
+			return nil, fmt.Errorf("syscall.ParseUnixRights: %s", err)
+		}
+		fds = append(fds, rights...)
+	}
+	for _, fd := range fds {
+		syscall.CloseOnExec(fd)
+	}
+
+	if n == 0 {
+		closeFds(fds)
+		return nil, fmt.Errorf("handover connection closed")
+	}
+	if flags&(syscall.MSG_TRUNC|syscall.MSG_CTRUNC) != 0 {
+		closeFds(fds)
+		return nil, fmt.Errorf("handover message truncated")
+	}
+
+	err = json.Unmarshal(b[:n], v)
+	if err != nil {
+		closeFds(fds)
+		return nil, fmt.Errorf("invalid handover message: %v", err)
+	}
+
+	return fds, nil
+}
+
+// closeFds closes all fds
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
+
+// NewSocketFromHandover returns a new Socket taking over the listener and
+// connected server ports of a socket in another process, which calls
+// Socket.Handover on the other end of conn. A handed over port is resumed
+// once NewPort is called with a server PortCfg of the same Id: it is
+// connected right away, ConnectedFunc is called and its queues continue
+// where the other process stopped. The MemoryConfig negotiated with the
+// peer is kept. Ports not created until the socket is closed are
+// disconnected.
+func NewSocketFromHandover(appName string, conn *net.UnixConn, opts ...SocketOption) (*Socket, error) {
+	var hs handoverSocket
+
+	fds, err := recvHandoverMsg(conn, &hs)
+	if err != nil {
+		return nil, err
+	}
+	if hs.Version != handoverVersion {
+		closeFds(fds)
+		return nil, fmt.Errorf("unsupported handover version %d", hs.Version)
+	}
+	if (hs.HasListener && len(fds) != 1) || (!hs.HasListener && len(fds) != 0) {
+		closeFds(fds)
+		return nil, fmt.Errorf("invalid handover message: unexpected number of fds %d", len(fds))
+	}
+
+	socket, err := NewSocket(appName, hs.Filename, opts...)
+	if err != nil {
+		closeFds(fds)
+		return nil, err
+	}
+
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+
+	socket.handover = make(map[uint32]*handoverPort)
+	if hs.HasListener {
+		err = socket.AddListener(fds[0])
+		if err != nil {
+			closeFds(fds)
+			socket.closeHandover()
+			return nil, err
+		}
+		socket.ownsFile = hs.OwnsFile
+	}
+
+	for i := 0; i < hs.NumPorts; i++ {
+		hp := &handoverPort{}
+		hp.fds, err = recvHandoverMsg(conn, hp)
+		if err == nil && len(hp.fds) != hp.numFds() {
+			hp.close()
+			err = fmt.Errorf("invalid handover message: port %d: unexpected number of fds %d", hp.Id, len(hp.fds))
+		}
+		if err != nil {
+			socket.closeHandover()
+			if socket.listener != nil {
+				socket.listener.close()
+				socket.listener = nil
+			}
+			if socket.ownPoller {
+				socket.poller.Close()
+			}
+			return nil, err
+		}
+		socket.handover[hp.Id] = hp
+	}
+
+	socket.logger.Info("socket taken over", socket.logArgs("ports", hs.NumPorts)...)
+
+	return socket, nil
+}
+
+// closeHandover closes fds of handed over ports that were not resumed,
+// socket lock must be held
+func (socket *Socket) closeHandover() {
+	for id, hp := range socket.handover {
+		hp.close()
+		delete(socket.handover, id)
+	}
+}
+
+// resume connects a port using the state handed over by another
+// process, socket lock must be held
+func (p *Port) resume(hp *handoverPort) error {
+	fds := hp.fds
+	hp.fds = nil
+
+	// validate state before anything is mapped, the rings must lie
+	// within the regions like rings added by the peer
+	for i, r := range hp.Regions {
+		p.regions = append(p.regions, memoryRegion{
+			size:               r.Size,
+			fd:                 fds[1+i],
+			packetBufferOffset: r.PacketBufferOffset,
+		})
+	}
+	for _, q := range append(append([]handoverQueue{}, hp.TxQueues...), hp.RxQueues...) {
+		err := p.checkRingBounds(q.Region, q.Offset, q.Log2Size)
+		if err != nil {
+			p.regions = nil
+			closeFds(fds)
+			return fmt.Errorf("invalid handover state: %w", err)
+		}
+	}
+	// region fds received from the peer are checked again, an unsealed
+	// region makes datapath faults recoverable as it did in the old process
+	for i, r := range hp.Regions {
+		err := p.checkRegionFd(fds[1+i], r.Size)
+		if err != nil {
+			p.regions = nil
+			closeFds(fds)
+			p.guardFaults = false
+			return fmt.Errorf("invalid handover state: region %d: %w", i, err)
+		}
+	}
+
+	cc, err := p.socket.addControlChannel(fds[0], p)
+	if err != nil {
+		p.regions = nil
+		p.guardFaults = false
+		closeFds(fds)
+		return fmt.Errorf("failed to create control channel: %v", err)
+	}
+	cc.isConnected = true
+	// accepted by the listener of the other process
+	cc.accepted = true
+	cc.peerFeatures = hp.Features
+	p.cc = cc
+	p.peerCred.Store(cc.peerCred)
+	p.setLinkState(linkStateConnecting)
+
+	p.run = hp.Run
+	p.remoteName = hp.RemoteName
+	p.peerName = hp.PeerName
+
+	fds = fds[1+len(hp.Regions):]
+	for _, q := range hp.TxQueues {
+		p.txQueues = append(p.txQueues, p.resumeQueue(q, fds[0]))
+		fds = fds[1:]
+	}
+	for _, q := range hp.RxQueues {
+		p.rxQueues = append(p.rxQueues, p.resumeQueue(q, fds[0]))
+		fds = fds[1:]
+	}
+
+	p.socket.logger.Info("port resumed", p.logArgs("peer_name", p.peerName)...)
+
+	err = p.connect(true)
+	if err != nil {
+		if cc.closed {
+			// disconnected while ConnectedFunc ran
+			return err
+		}
+		return cc.close(true, err)
+	}
+	p.setLinkState(linkStateUp)
+
+	return nil
+}
+
+// resumeQueue returns a queue from the handed over state
+func (p *Port) resumeQueue(hq handoverQueue, interruptFd int) Queue {
+	q := Queue{
+		ring:        newRing(hq.Region, hq.RingType, hq.Offset, hq.Log2Size),
+		port:        p,
+		lastHead:    hq.LastHead,
+		lastTail:    hq.LastTail,
+		interruptFd: interruptFd,
+	}
+	return q
+}
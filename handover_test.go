@@ -0,0 +1,246 @@
+package zmemif
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// handoverConns returns both ends of a connected "unixpacket" socket pair
+func handoverConns(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns []*net.UnixConn
+	for _, fd := range fds {
+		f := os.NewFile(uintptr(fd), "handover")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		conns = append(conns, c.(*net.UnixConn))
+	}
+	return conns[0], conns[1]
+}
+
+// handOver hands the ports of srv over to a new socket and returns it
+// polling
+func handOver(t *testing.T, srv *Socket) *Socket {
+	t.Helper()
+	a, b := handoverConns(t)
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- srv.Handover(ctx, a)
+	}()
+	nsrv, err := NewSocketFromHandover("srv", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(nsrv)
+	t.Cleanup(func() { closeSocket(t, nsrv) })
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	nsrv.StartPolling()
+	return nsrv
+}
+
+// readPackets reads up to n packets from rx queue 0 of p
+func readPackets(p *Port, n int) (pkts []string) {
+	rq, err := p.GetRxQueue(0)
+	if err != nil {
+		return nil
+	}
+	buf := make([]byte, 2048)
+	for len(pkts) < n {
+		l, err := rq.ReadPacket(buf)
+		if err != nil || l == 0 {
+			break
+		}
+		pkts = append(pkts, string(buf[:l]))
+	}
+	return pkts
+}
+
+// TestHandoverRingPositions checks that a resumed port continues reading
+// where the port of the other process stopped
+func TestHandoverRingPositions(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "memif.sock")
+	srv, err := NewSocket("srv", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(srv)
+
+	start := make(chan struct{})
+	read := make(chan []string, 1)
+	reader := func(n int) ConnectedFunc {
+		return func(p *Port) error {
+			p.Wg.Add(1)
+			go func() {
+				defer p.Wg.Done()
+				<-start
+				read <- readPackets(p, n)
+			}()
+			return nil
+		}
+	}
+	_, err = NewPort(srv, &PortCfg{Id: 0, Name: "srv", IsServer: true, ConnectedFunc: reader(2)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.StartPolling()
+
+	lp := newLayoutPeer(dialRaw(t, file), dpdkLayout(1, 1))
+	lp.connect()
+	for _, pkt := range []string{"a", "b", "c"} {
+		lp.transmit(0, []byte(pkt))
+	}
+	close(start)
+	if pkts := <-read; fmt.Sprint(pkts) != "[a b]" {
+		t.Fatalf("read %q before handover", pkts)
+	}
+
+	nsrv := handOver(t, srv)
+	_, err = NewPort(nsrv, &PortCfg{Id: 0, Name: "srv", IsServer: true, ConnectedFunc: reader(3)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pkts := <-read:
+		if fmt.Sprint(pkts) != "[c]" {
+			t.Fatalf("read %q after handover", pkts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("port not resumed")
+	}
+}
+
+// TestHandoverUnsealedRegion hands over a port whose peer region is not
+// sealed against shrinking, the resumed port must still guard against
+// memory faults
+func TestHandoverUnsealedRegion(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "memif.sock")
+	srv, err := NewSocket("srv", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(srv)
+
+	guarded := make(chan bool, 1)
+	_, err = NewPort(srv, &PortCfg{Id: 0, Name: "srv", IsServer: true, ConnectedFunc: func(p *Port) error {
+		guarded <- p.guardFaults
+		return nil
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.StartPolling()
+
+	// the peer maps memfds created without sealing
+	lp := newLayoutPeer(dialRaw(t, file), dpdkLayout(1, 1))
+	lp.connect()
+	if !<-guarded {
+		t.Fatal("unsealed region not guarded")
+	}
+
+	nsrv := handOver(t, srv)
+	np, err := NewPort(nsrv, &PortCfg{Id: 0, Name: "srv", IsServer: true, ConnectedFunc: nopConnected}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nsrv.mu.Lock()
+	resumed, guardFaults := np.cc != nil && np.cc.isConnected, np.guardFaults
+	nsrv.mu.Unlock()
+	if !resumed {
+		t.Fatalf("port not resumed: %v", np.DisconnectReason())
+	}
+	if !guardFaults {
+		t.Fatal("resumed port doesn't guard the unsealed region")
+	}
+}
+
+// handoverFds returns the fds of a handed over port with one region of
+// size bytes and one queue: control channel, region and interrupt
+func handoverFds(t *testing.T, size int) []int {
+	t.Helper()
+	pair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(pair[1])
+	mfd, err := memfdCreate("handover", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Ftruncate(mfd, int64(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	efd, err := eventFd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []int{pair[0], mfd, efd}
+}
+
+// TestHandoverRingBounds resumes ports from handover state whose ring
+// lies outside of its region, the port must not be resumed and the
+// handed over fds must be closed
+func TestHandoverRingBounds(t *testing.T) {
+	const regionSize = 4096
+	for _, q := range []handoverQueue{
+		{Region: 1, Log2Size: 4},
+		{Region: -1, Log2Size: 4},
+		{Offset: regionSize - memifRingDesc, Log2Size: 4},
+		{Offset: -1, Log2Size: 4},
+		{Log2Size: -1},
+		{Log2Size: 16},
+	} {
+		srv, err := NewSocket("srv", filepath.Join(t.TempDir(), "memif.sock"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		drainErrors(srv)
+		// the first server port opens the listener
+		_, err = NewPort(srv, &PortCfg{Id: 1, Name: "other", IsServer: true, ConnectedFunc: nopConnected}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		base := countFds(t)
+		srv.mu.Lock()
+		srv.handover = map[uint32]*handoverPort{0: {
+			Regions:  []handoverRegion{{Size: regionSize}},
+			TxQueues: []handoverQueue{q},
+			fds:      handoverFds(t, regionSize),
+		}}
+		srv.mu.Unlock()
+
+		p, err := NewPort(srv, &PortCfg{Id: 0, Name: "srv", IsServer: true, ConnectedFunc: nopConnected}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.mu.Lock()
+		resumed := p.cc != nil || len(p.regions) > 0 || len(p.txQueues) > 0
+		srv.mu.Unlock()
+		if resumed || p.IsConnecting() {
+			t.Fatalf("ring %+v resumed", q)
+		}
+		if n := countFds(t); n > base {
+			t.Fatalf("ring %+v: %d fds open, %d before", q, n, base)
+		}
+		closeSocket(t, srv)
+	}
+}
@@ -0,0 +1,148 @@
+package zmemif
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+const hugetlbfsMagic = 0x958458f6
+
+// HugePageSize selects the hugepage size backing memfd regions
+type HugePageSize uint8
+
+const (
+	HugePageNone HugePageSize = iota // normal pages
+	HugePage2MB
+	HugePage1GB
+)
+
+// bytes returns the page size in bytes
+func (s HugePageSize) bytes() uint64 {
+	switch s {
+	case HugePage2MB:
+		return 2 << 20
+	case HugePage1GB:
+		return 1 << 30
+	}
+	return uint64(os.Getpagesize())
+}
+
+// mfdFlags returns memfd_create flags selecting the page size
+func (s HugePageSize) mfdFlags() int {
+	switch s {
+	case HugePage2MB:
+		return mfd_hugetlb | 21<<mfd_huge_shift
+	case HugePage1GB:
+		return mfd_hugetlb | 30<<mfd_huge_shift
+	}
+	return 0
+}
+
+// HugePageConfig selects hugepage backed shared memory for regions
+// created by a client port. Region sizes are rounded up to the page
+// size.
+type HugePageConfig struct {
+	Size     HugePageSize // memfd hugepage size
+	Path     string       // optional hugetlbfs mount, regions are created as files there, overrides Size
+	Fallback bool         // use normal pages if hugepages are not available
+}
+
+// enabled returns true if regions are backed by hugepages
+func (hp *HugePageConfig) enabled() bool {
+	return hp.Size != HugePageNone || hp.Path != ""
+}
+
+// allocRegion creates, sizes and maps shared memory for region r (client
+// only). r.size is rounded up to the page size.
+func (p *Port) allocRegion(r *memoryRegion, index int) (err error) {
+	name := fmt.Sprintf("memif_region_%d", index)
+	hp := &p.cfg.HugePages
+
+	if hp.enabled() {
+		err = allocHugeRegion(r, name, hp)
+		if err == nil {
+			return nil
+		}
+		err = fmt.Errorf("%w: %v", ErrHugePagesUnavailable, err)
+		if !hp.Fallback {
+			return err
+		}
+		p.socket.logger.Warn("falling back to normal pages", p.logArgs("region", index, "error", err)...)
+	}
+
+	fd, err := memfdCreate(name, mfd_allow_sealing)
+	if err != nil {
+		return err
+	}
+	return mapRegion(r, fd, HugePageNone.bytes(), true)
+}
+
+// allocHugeRegion creates region r backed by hugepages
+func allocHugeRegion(r *memoryRegion, name string, hp *HugePageConfig) error {
+	if hp.Path == "" {
+		fd, err := memfdCreate(name, mfd_allow_sealing|hp.Size.mfdFlags())
+		if err != nil {
+			return err
+		}
+		return mapRegion(r, fd, hp.Size.bytes(), true)
+	}
+
+	var st syscall.Statfs_t
+	err := syscall.Statfs(hp.Path, &st)
+	if err != nil {
+		return fmt.Errorf("statfs %s: %v", hp.Path, err)
+	}
+	if st.Type != hugetlbfsMagic {
+		return fmt.Errorf("%s is not a hugetlbfs mount", hp.Path)
+	}
+
+	// the file is unlinked right away, the region lives as long as its fds
+	f, err := os.CreateTemp(hp.Path, name+"_*")
+	if err != nil {
+		return err
+	}
+	os.Remove(f.Name())
+	// the duplicate is close-on-exec from the start, a concurrent fork
+	// must not inherit it
+	r0, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_DUPFD_CLOEXEC, 0)
+	f.Close()
+	if errno != 0 {
+		return os.NewSyscallError("fcntl", errno)
+	}
+	fd := int(r0)
+
+	// hugetlbfs files can't be sealed
+	return mapRegion(r, fd, uint64(st.Bsize), false)
+}
+
+// mapRegion rounds r.size up to pageSize, sizes fd and maps it. fd is
+// closed on error.
+func mapRegion(r *memoryRegion, fd int, pageSize uint64, seal bool) (err error) {
+	size := (r.size + pageSize - 1) / pageSize * pageSize
+
+	if seal {
+		_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), uintptr(f_add_seals), uintptr(f_seal_shrink))
+		if errno != 0 {
+			syscall.Close(fd)
+			return fmt.Errorf("memfdCreate: %w", os.NewSyscallError("fcntl", errno))
+		}
+	}
+
+	err = syscall.Ftruncate(fd, int64(size))
+	if err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("ftruncate: %w", err)
+	}
+
+	data, err := syscall.Mmap(fd, 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("mmap: %w", err)
+	}
+
+	r.fd = fd
+	r.data = data
+	r.size = size
+	return nil
+}
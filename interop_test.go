@@ -0,0 +1,487 @@
+package zmemif
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/zartbot/zmemif/controlmsg"
+)
+
+// memif_ring_t and memif_desc_t layout from memif.h, independent of the
+// package constants
+const (
+	memifRingCookie   = 0
+	memifRingHead     = 6
+	memifRingTail     = 64
+	memifRingDesc     = 128
+	memifDescRegion   = 2
+	memifDescLength   = 4
+	memifDescOffset   = 8
+	memifDescSize     = 16
+	memifBufferSize   = 2048
+	memifLog2RingSize = 4
+)
+
+// rawPeer is a memif client speaking the control protocol directly,
+// standing in for DPDK and libmemif peers
+type rawPeer struct {
+	t  *testing.T
+	fd int
+}
+
+// dialRaw connects a rawPeer to the socket file and reads the servers Hello
+func dialRaw(t *testing.T, file string) *rawPeer {
+	t.Helper()
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &rawPeer{t: t, fd: fd}
+	t.Cleanup(r.close)
+	err = syscall.Connect(fd, &syscall.SockaddrUnix{Name: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.expect(controlmsg.TypeHello)
+	return r
+}
+
+func (r *rawPeer) close() {
+	if r.fd >= 0 {
+		syscall.Close(r.fd)
+		r.fd = -1
+	}
+}
+
+func (r *rawPeer) send(msg controlmsg.Message, fd int) {
+	r.t.Helper()
+	b, oob, err := controlmsg.Encode(msg, fd)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	err = syscall.Sendmsg(r.fd, b, oob, nil, 0)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+func (r *rawPeer) recv() controlmsg.Message {
+	r.t.Helper()
+	b := make([]byte, controlmsg.Size)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := syscall.Recvmsg(r.fd, b, oob, 0)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	msg, fd, err := controlmsg.Decode(b[:n], oob[:oobn])
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	if fd >= 0 {
+		syscall.Close(fd)
+	}
+	return msg
+}
+
+// expect receives a message and fails the test unless it is of type mt
+func (r *rawPeer) expect(mt controlmsg.Type) controlmsg.Message {
+	r.t.Helper()
+	msg := r.recv()
+	if msg.Type() != mt {
+		r.t.Fatalf("received %s %+v, want %s", msg.Type(), msg, mt)
+	}
+	return msg
+}
+
+// sharedMemory returns a memfd of size bytes and its mapping
+func sharedMemory(t *testing.T, size int) (int, []byte) {
+	t.Helper()
+	fd, err := memfdCreate("peer", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Ftruncate(fd, int64(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := syscall.Mmap(fd, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		syscall.Munmap(data)
+		syscall.Close(fd)
+	})
+	return fd, data
+}
+
+// peerLayout describes the memory a client sets up: the region sizes,
+// where each ring lives and which buffer each descriptor points to
+type peerLayout struct {
+	name       string
+	numS2M     int
+	numM2S     int
+	regions    []int
+	ringOffset func(ringType ringType, index int) int
+	buffer     func(ringType ringType, index, slot int) (region int, offset int)
+}
+
+const memifRingBytes = memifRingDesc + memifDescSize<<memifLog2RingSize
+
+// ringNum numbers rings like DPDK and libmemif, S2M rings first
+func (l *peerLayout) ringNum(ringType ringType, index int) int {
+	if ringType == ringTypeM2S {
+		return l.numS2M + index
+	}
+	return index
+}
+
+// dpdkLayout is the layout of DPDK net_memif in copy mode, rings and
+// buffers share region 0, buffers follow the rings
+func dpdkLayout(numS2M, numM2S int) *peerLayout {
+	l := &peerLayout{name: "net_memif", numS2M: numS2M, numM2S: numM2S}
+	rings := (numS2M + numM2S) * memifRingBytes
+	l.regions = []int{rings + (numS2M+numM2S)<<memifLog2RingSize*memifBufferSize}
+	l.ringOffset = func(ringType ringType, index int) int {
+		return l.ringNum(ringType, index) * memifRingBytes
+	}
+	l.buffer = func(ringType ringType, index, slot int) (int, int) {
+		n := l.ringNum(ringType, index)<<memifLog2RingSize + slot
+		return 0, rings + n*memifBufferSize
+	}
+	return l
+}
+
+// libmemifLayout is the layout of libmemif, region 0 holds the rings and
+// region 1 the buffers
+func libmemifLayout(numS2M, numM2S int) *peerLayout {
+	l := &peerLayout{name: "libmemif", numS2M: numS2M, numM2S: numM2S}
+	l.regions = []int{
+		(numS2M + numM2S) * memifRingBytes,
+		(numS2M + numM2S) << memifLog2RingSize * memifBufferSize,
+	}
+	l.ringOffset = func(ringType ringType, index int) int {
+		return l.ringNum(ringType, index) * memifRingBytes
+	}
+	l.buffer = func(ringType ringType, index, slot int) (int, int) {
+		n := l.ringNum(ringType, index)<<memifLog2RingSize + slot
+		return 1, n * memifBufferSize
+	}
+	return l
+}
+
+// dpdkZeroCopyLayout is the layout of DPDK net_memif in zero-copy mode,
+// region 0 holds the rings and mbufs of two memseg lists are exposed as
+// regions 1 and 2. Buffers are mbuf data rooms, interleaved between the
+// regions and not aligned to the buffer size.
+func dpdkZeroCopyLayout(numS2M, numM2S int) *peerLayout {
+	// mempool object header, struct rte_mbuf and headroom precede the
+	// data room
+	const mbufDataOffset = 64 + 128 + 128
+	const mbufSize = mbufDataOffset + memifBufferSize
+	l := &peerLayout{name: "net_memif zero-copy", numS2M: numS2M, numM2S: numM2S}
+	mbufs := (numS2M + numM2S) << memifLog2RingSize
+	l.regions = []int{
+		(numS2M + numM2S) * memifRingBytes,
+		(mbufs + 1) / 2 * mbufSize,
+		(mbufs + 1) / 2 * mbufSize,
+	}
+	l.ringOffset = func(ringType ringType, index int) int {
+		return l.ringNum(ringType, index) * memifRingBytes
+	}
+	l.buffer = func(ringType ringType, index, slot int) (int, int) {
+		// hand out mbufs from the end of the pool
+		n := mbufs - 1 - (l.ringNum(ringType, index)<<memifLog2RingSize + slot)
+		return 1 + n%2, n/2*mbufSize + mbufDataOffset
+	}
+	return l
+}
+
+// layoutPeer is a rawPeer client with the memory of a peerLayout
+type layoutPeer struct {
+	*rawPeer
+	layout  *peerLayout
+	fds     []int
+	regions [][]byte
+	// lastTail of each M2S ring
+	lastTail []uint16
+}
+
+// newLayoutPeer sets up the regions and rings of layout
+func newLayoutPeer(r *rawPeer, layout *peerLayout) *layoutPeer {
+	lp := &layoutPeer{rawPeer: r, layout: layout, lastTail: make([]uint16, layout.numM2S)}
+	for _, size := range layout.regions {
+		fd, data := sharedMemory(r.t, size)
+		lp.fds = append(lp.fds, fd)
+		lp.regions = append(lp.regions, data)
+	}
+	for _, rt := range []ringType{ringTypeS2M, ringTypeM2S} {
+		for i := 0; i < lp.numRings(rt); i++ {
+			ring := lp.ring(rt, i)
+			binary.LittleEndian.PutUint32(ring[memifRingCookie:], cookie)
+			for slot := 0; slot < 1<<memifLog2RingSize; slot++ {
+				region, offset := layout.buffer(rt, i, slot)
+				d := lp.desc(rt, i, slot)
+				binary.LittleEndian.PutUint16(d[memifDescRegion:], uint16(region))
+				binary.LittleEndian.PutUint32(d[memifDescLength:], memifBufferSize)
+				binary.LittleEndian.PutUint32(d[memifDescOffset:], uint32(offset))
+			}
+		}
+	}
+	return lp
+}
+
+func (lp *layoutPeer) numRings(ringType ringType) int {
+	if ringType == ringTypeS2M {
+		return lp.layout.numS2M
+	}
+	return lp.layout.numM2S
+}
+
+func (lp *layoutPeer) ring(ringType ringType, index int) []byte {
+	return lp.regions[0][lp.layout.ringOffset(ringType, index):]
+}
+
+func (lp *layoutPeer) desc(ringType ringType, index, slot int) []byte {
+	return lp.ring(ringType, index)[memifRingDesc+slot*memifDescSize:][:memifDescSize]
+}
+
+// connect runs the client side of the handshake in DPDK and libmemif
+// order: Init, all regions, S2M rings, M2S rings, Connect
+func (lp *layoutPeer) connect() {
+	init := controlmsg.Init{Version: controlmsg.Version}
+	copy(init.Name[:], lp.layout.name)
+	lp.send(&init, -1)
+	lp.expect(controlmsg.TypeAck)
+	for i, fd := range lp.fds {
+		lp.send(&controlmsg.AddRegion{Index: uint16(i), Size: uint64(len(lp.regions[i]))}, fd)
+		lp.expect(controlmsg.TypeAck)
+	}
+	for _, rt := range []ringType{ringTypeS2M, ringTypeM2S} {
+		for i := 0; i < lp.numRings(rt); i++ {
+			efd, err := eventFd()
+			if err != nil {
+				lp.t.Fatal(err)
+			}
+			addRing := controlmsg.AddRing{
+				Index:        uint16(i),
+				Offset:       uint32(lp.layout.ringOffset(rt, i)),
+				RingSizeLog2: memifLog2RingSize,
+			}
+			if rt == ringTypeS2M {
+				addRing.Flags = controlmsg.AddRingFlagS2M
+			}
+			lp.send(&addRing, efd)
+			syscall.Close(efd)
+			lp.expect(controlmsg.TypeAck)
+		}
+	}
+	connect := controlmsg.Connect{}
+	copy(connect.Name[:], "memif0")
+	lp.send(&connect, -1)
+	lp.expect(controlmsg.TypeConnected)
+}
+
+// transmit writes a packet to S2M ring index like the peers tx path,
+// the descriptor keeps the region and offset set up by the layout
+func (lp *layoutPeer) transmit(index int, pkt []byte) {
+	ring := lp.ring(ringTypeS2M, index)
+	head := binary.LittleEndian.Uint16(ring[memifRingHead:])
+	slot := int(head) & (1<<memifLog2RingSize - 1)
+	d := lp.desc(ringTypeS2M, index, slot)
+	region, offset := lp.layout.buffer(ringTypeS2M, index, slot)
+	copy(lp.regions[region][offset:], pkt)
+	binary.LittleEndian.PutUint32(d[memifDescLength:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint16(ring[memifRingHead:], head+1)
+}
+
+// refill hands all free M2S descriptors of ring index to the server
+func (lp *layoutPeer) refill(index int) {
+	ring := lp.ring(ringTypeM2S, index)
+	binary.LittleEndian.PutUint16(ring[memifRingHead:], lp.lastTail[index]+1<<memifLog2RingSize)
+}
+
+// receive returns the packets the server wrote to M2S ring index, it
+// fails if the server moved a descriptor to another buffer
+func (lp *layoutPeer) receive(index int) (pkts []string, err error) {
+	ring := lp.ring(ringTypeM2S, index)
+	tail := binary.LittleEndian.Uint16(ring[memifRingTail:])
+	for ; lp.lastTail[index] != tail; lp.lastTail[index]++ {
+		slot := int(lp.lastTail[index]) & (1<<memifLog2RingSize - 1)
+		d := lp.desc(ringTypeM2S, index, slot)
+		region := int(binary.LittleEndian.Uint16(d[memifDescRegion:]))
+		length := int(binary.LittleEndian.Uint32(d[memifDescLength:]))
+		offset := int(binary.LittleEndian.Uint32(d[memifDescOffset:]))
+		wantRegion, wantOffset := lp.layout.buffer(ringTypeM2S, index, slot)
+		if region != wantRegion || offset != wantOffset {
+			return nil, fmt.Errorf("M2S ring %d slot %d points to region %d offset %d, want region %d offset %d",
+				index, slot, region, offset, wantRegion, wantOffset)
+		}
+		pkts = append(pkts, string(lp.regions[region][offset:offset+length]))
+		binary.LittleEndian.PutUint32(d[memifDescLength:], memifBufferSize)
+	}
+	return pkts, nil
+}
+
+// TestServerPeerLayouts connects server ports to stand-in clients setting
+// up memory like DPDK net_memif and libmemif and exchanges packets on
+// every queue
+func TestServerPeerLayouts(t *testing.T) {
+	for _, layout := range []*peerLayout{
+		dpdkLayout(2, 2),
+		dpdkLayout(3, 1),
+		libmemifLayout(2, 2),
+		libmemifLayout(1, 3),
+		dpdkZeroCopyLayout(2, 2),
+	} {
+		t.Run(fmt.Sprintf("%s/%dx%d", layout.name, layout.numS2M, layout.numM2S), func(t *testing.T) {
+			testServerPeerLayout(t, layout)
+		})
+	}
+}
+
+func testServerPeerLayout(t *testing.T, layout *peerLayout) {
+	file := filepath.Join(t.TempDir(), "memif.sock")
+	srv, err := NewSocket("srv", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(srv)
+	defer closeSocket(t, srv)
+
+	// the packets are exchanged by a port worker, like an application
+	// would
+	peer := make(chan *layoutPeer, 1)
+	result := make(chan error, 1)
+	_, err = NewPort(srv, &PortCfg{Id: 0, Name: "srv", IsServer: true, ConnectedFunc: func(p *Port) error {
+		p.Wg.Add(1)
+		go func() {
+			defer p.Wg.Done()
+			result <- exchangePackets(p, <-peer)
+		}()
+		return nil
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.StartPolling()
+
+	lp := newLayoutPeer(dialRaw(t, file), layout)
+	peer <- lp
+	lp.connect()
+	select {
+	case err = <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out exchanging packets")
+	}
+}
+
+// exchangePackets checks the servers queues against the rings of lp,
+// several rounds wrap the rings
+func exchangePackets(p *Port, lp *layoutPeer) error {
+	layout := lp.layout
+	if p.GetRemoteName() != layout.name || p.GetPeerName() != "memif0" {
+		return fmt.Errorf("remote name %q peer name %q", p.GetRemoteName(), p.GetPeerName())
+	}
+	if p.NumRxQueues() != layout.numS2M || p.NumTxQueues() != layout.numM2S {
+		return fmt.Errorf("server queues rx %d tx %d", p.NumRxQueues(), p.NumTxQueues())
+	}
+
+	buf := make([]byte, memifBufferSize)
+	for round := 0; round < 4; round++ {
+		for q := 0; q < layout.numS2M; q++ {
+			rq, err := p.GetRxQueue(q)
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 10; i++ {
+				lp.transmit(q, []byte(fmt.Sprintf("s2m q%d r%d i%d", q, round, i)))
+			}
+			for i := 0; i < 10; i++ {
+				n, err := rq.ReadPacket(buf)
+				if err != nil {
+					return err
+				}
+				want := fmt.Sprintf("s2m q%d r%d i%d", q, round, i)
+				if string(buf[:n]) != want {
+					return fmt.Errorf("read %q, want %q", buf[:n], want)
+				}
+			}
+		}
+		for q := 0; q < layout.numM2S; q++ {
+			tq, err := p.GetTxQueue(q)
+			if err != nil {
+				return err
+			}
+			lp.refill(q)
+			for i := 0; i < 10; i++ {
+				_, err = tq.WritePacket([]byte(fmt.Sprintf("m2s q%d r%d i%d", q, round, i)))
+				if err != nil {
+					return err
+				}
+			}
+			pkts, err := lp.receive(q)
+			if err != nil {
+				return err
+			}
+			if len(pkts) != 10 {
+				return fmt.Errorf("peer received %d packets on queue %d: %q", len(pkts), q, pkts)
+			}
+			for i, pkt := range pkts {
+				want := fmt.Sprintf("m2s q%d r%d i%d", q, round, i)
+				if pkt != want {
+					return fmt.Errorf("peer received %q, want %q", pkt, want)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// TestPeerDisconnectCodes sends a disconnect code from a standard memif
+// peer and from a zmemif peer, only the zmemif code maps to a
+// DisconnectCode
+func TestPeerDisconnectCodes(t *testing.T) {
+	for _, features := range []uint32{0, controlmsg.FeatureDisconnectCodes} {
+		file := filepath.Join(t.TempDir(), "memif.sock")
+		srv, err := NewSocket("srv", file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		drainErrors(srv)
+		p, err := NewPort(srv, &PortCfg{Id: 0, Name: "srv", IsServer: true, ConnectedFunc: nopConnected}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv.StartPolling()
+
+		r := dialRaw(t, file)
+		r.send(&controlmsg.Init{Version: controlmsg.Version, Features: features}, -1)
+		r.expect(controlmsg.TypeAck)
+		dc := controlmsg.Disconnect{Code: uint32(DisconnectCodeInvalidSecret)}
+		copy(dc.String[:], "bye")
+		r.send(&dc, -1)
+		waitFor(t, "port disconnected", func() bool { return p.DisconnectReason() != nil })
+
+		var dcErr *DisconnectError
+		if !errors.As(p.DisconnectReason(), &dcErr) || !dcErr.Remote || dcErr.Reason != "bye" {
+			t.Fatalf("features %#x: disconnect %v", features, p.DisconnectReason())
+		}
+		if features == 0 {
+			if dcErr.Code != DisconnectCodeNone || dcErr.PeerCode != dc.Code || errors.Is(dcErr, ErrInvalidSecret) {
+				t.Fatalf("standard peer: %v", dcErr)
+			}
+		} else if dcErr.Code != DisconnectCodeInvalidSecret || dcErr.PeerCode != 0 || !errors.Is(dcErr, ErrInvalidSecret) {
+			t.Fatalf("zmemif peer: %v", dcErr)
+		}
+		closeSocket(t, srv)
+	}
+}
@@ -0,0 +1,127 @@
+package zmemif
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ListenerLimits bounds the control channels accepted by the listener.
+// Peers over a limit are sent a disconnect with
+// DisconnectCodeConnectionLimit and reported by EventPeerRejected. Zero
+// values don't limit.
+type ListenerLimits struct {
+	MaxPending int     // maximum number of control channels not yet assigned to a port by MsgInit
+	MaxPerUid  int     // maximum number of control channels per peer user id
+	MaxPerPid  int     // maximum number of control channels per peer process id
+	AcceptRate float64 // maximum number of accepted connections per second
+	// AcceptBurst is the number of connections accepted at once before
+	// AcceptRate applies, default is 1 or AcceptRate, whichever is larger
+	AcceptBurst int
+}
+
+// ListenerStats counts the connections handled by the listener, see
+// Socket.ListenerStats
+type ListenerStats struct {
+	Accepted        uint64 // connections that passed the limits and the sockets PeerCredPolicy
+	RejectedPending uint64 // connections rejected by ListenerLimits.MaxPending
+	RejectedUid     uint64 // connections rejected by ListenerLimits.MaxPerUid
+	RejectedPid     uint64 // connections rejected by ListenerLimits.MaxPerPid
+	RejectedRate    uint64 // connections rejected by ListenerLimits.AcceptRate
+}
+
+// listenerStats holds the ListenerStats counters
+type listenerStats struct {
+	accepted        atomic.Uint64
+	rejectedPending atomic.Uint64
+	rejectedUid     atomic.Uint64
+	rejectedPid     atomic.Uint64
+	rejectedRate    atomic.Uint64
+}
+
+// ListenerStats returns the connection counters of the listener. It is
+// safe to call from any goroutine.
+func (socket *Socket) ListenerStats() ListenerStats {
+	s := &socket.listenerStats
+	return ListenerStats{
+		Accepted:        s.accepted.Load(),
+		RejectedPending: s.rejectedPending.Load(),
+		RejectedUid:     s.rejectedUid.Load(),
+		RejectedPid:     s.rejectedPid.Load(),
+		RejectedRate:    s.rejectedRate.Load(),
+	}
+}
+
+// acceptLimiter is a token bucket limiting the accept rate
+type acceptLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token from the bucket if one is available
+func (al *acceptLimiter) allow(limits *ListenerLimits, now time.Time) bool {
+	burst := float64(limits.AcceptBurst)
+	if burst <= 0 {
+		burst = max(1, limits.AcceptRate)
+	}
+
+	if al.last.IsZero() {
+		al.tokens = burst
+	} else {
+		al.tokens = min(burst, al.tokens+now.Sub(al.last).Seconds()*limits.AcceptRate)
+	}
+	al.last = now
+
+	if al.tokens < 1 {
+		return false
+	}
+	al.tokens--
+	return true
+}
+
+// checkLimits verifies that a newly accepted control channel is within
+// the listener limits, socket lock must be held. Only channels accepted
+// before count, outgoing channels of client ports don't.
+func (cc *controlChannel) checkLimits() error {
+	socket := cc.socket
+	limits := &socket.listenerLimits
+	stats := &socket.listenerStats
+
+	if limits.AcceptRate > 0 && !socket.acceptLimiter.allow(limits, time.Now()) {
+		stats.rejectedRate.Add(1)
+		return fmt.Errorf("%w: accept rate %g/s", ErrConnectionLimit, limits.AcceptRate)
+	}
+
+	var pending, perUid, perPid int
+	for _, other := range socket.ccs {
+		if !other.accepted {
+			continue
+		}
+		if other.port == nil {
+			pending++
+		}
+		if cc.peerCred != nil && other.peerCred != nil {
+			if other.peerCred.Uid == cc.peerCred.Uid {
+				perUid++
+			}
+			if other.peerCred.Pid == cc.peerCred.Pid {
+				perPid++
+			}
+		}
+	}
+
+	if limits.MaxPending > 0 && pending >= limits.MaxPending {
+		stats.rejectedPending.Add(1)
+		return fmt.Errorf("%w: %d pending control channels", ErrConnectionLimit, pending)
+	}
+	if limits.MaxPerUid > 0 && perUid >= limits.MaxPerUid {
+		stats.rejectedUid.Add(1)
+		return fmt.Errorf("%w: %d control channels of uid %d", ErrConnectionLimit, perUid, cc.peerCred.Uid)
+	}
+	if limits.MaxPerPid > 0 && perPid >= limits.MaxPerPid {
+		stats.rejectedPid.Add(1)
+		return fmt.Errorf("%w: %d control channels of pid %d", ErrConnectionLimit, perPid, cc.peerCred.Pid)
+	}
+
+	return nil
+}
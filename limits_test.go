@@ -0,0 +1,153 @@
+package zmemif
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/zartbot/zmemif/controlmsg"
+)
+
+// dialListener connects a raw peer to the listener and returns it with
+// the first message of the server, Hello if the peer was accepted
+func dialListener(t *testing.T, file string) (*rawPeer, controlmsg.Message) {
+	t.Helper()
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &rawPeer{t: t, fd: fd}
+	t.Cleanup(r.close)
+	err = syscall.Connect(fd, &syscall.SockaddrUnix{Name: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, r.recv()
+}
+
+// listeningSocket returns the socket file of a polling socket with a
+// server port, created with opts
+func listeningSocket(t *testing.T, opts ...SocketOption) (string, *Socket) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "memif.sock")
+	srv, err := NewSocket("srv", file, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(srv)
+	t.Cleanup(func() { closeSocket(t, srv) })
+	_, err = NewPort(srv, &PortCfg{Id: 0, Name: "srv", IsServer: true, ConnectedFunc: nopConnected}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.StartPolling()
+	return file, srv
+}
+
+// TestListenerLimitsAccounting checks that peers denied by the sockets
+// PeerCredPolicy are not counted as accepted, and that outgoing channels
+// of client ports don't take up the quota of inbound ones
+func TestListenerLimitsAccounting(t *testing.T) {
+	t.Run("policy denied", func(t *testing.T) {
+		deny := WithPeerCredPolicy(&PeerCredPolicy{UIDs: []uint32{uint32(os.Getuid()) + 1}})
+		file, srv := listeningSocket(t, deny, WithListenerLimits(ListenerLimits{MaxPerUid: 4}))
+		_, msg := dialListener(t, file)
+		if msg.Type() != controlmsg.TypeDisconnect {
+			t.Fatalf("denied peer got %s", msg.Type())
+		}
+		if stats := srv.ListenerStats(); stats != (ListenerStats{}) {
+			t.Fatalf("denied peer counted: %+v", stats)
+		}
+	})
+	t.Run("client channels", func(t *testing.T) {
+		// the client port connects to the sockets own listener, its
+		// outgoing channel has the same pid as the inbound one
+		file, srv := listeningSocket(t, WithListenerLimits(ListenerLimits{MaxPerPid: 1, MaxPending: 1}))
+		cp, err := NewPort(srv, &PortCfg{Id: 0, Name: "cli", ConnectedFunc: nopConnected}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "client connected", cp.IsConnected)
+		if stats := srv.ListenerStats(); stats != (ListenerStats{Accepted: 1}) {
+			t.Fatalf("stats %+v", stats)
+		}
+		// the connected inbound channel takes the only slot of the pid
+		_, msg := dialListener(t, file)
+		if msg.Type() != controlmsg.TypeDisconnect {
+			t.Fatalf("peer over MaxPerPid got %s", msg.Type())
+		}
+		if stats := srv.ListenerStats(); stats != (ListenerStats{Accepted: 1, RejectedPid: 1}) {
+			t.Fatalf("stats %+v", stats)
+		}
+	})
+}
+
+// TestListenerLimits connects peers over each limit, the listener must
+// disconnect them, report them and count them in ListenerStats
+func TestListenerLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		limits ListenerLimits
+		stats  ListenerStats
+	}{
+		{"pending", ListenerLimits{MaxPending: 2}, ListenerStats{Accepted: 2, RejectedPending: 1}},
+		{"uid", ListenerLimits{MaxPerUid: 2}, ListenerStats{Accepted: 2, RejectedUid: 1}},
+		{"pid", ListenerLimits{MaxPerPid: 2}, ListenerStats{Accepted: 2, RejectedPid: 1}},
+		{"rate", ListenerLimits{AcceptRate: 0.001, AcceptBurst: 2}, ListenerStats{Accepted: 2, RejectedRate: 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			events := make(chan Event, 16)
+			file, srv := listeningSocket(t, WithListenerLimits(tc.limits),
+				WithEventFunc(func(ev Event) { events <- ev }))
+			for i := 0; i < 2; i++ {
+				_, msg := dialListener(t, file)
+				if msg.Type() != controlmsg.TypeHello {
+					t.Fatalf("peer %d within limits got %s", i, msg.Type())
+				}
+			}
+			_, msg := dialListener(t, file)
+			dc, ok := msg.(*controlmsg.Disconnect)
+			if !ok || DisconnectCode(dc.Code) != DisconnectCodeConnectionLimit {
+				t.Fatalf("peer over the limit got %s %+v", msg.Type(), msg)
+			}
+			select {
+			case ev := <-events:
+				if ev.Type != EventPeerRejected || !errors.Is(ev.Err, ErrConnectionLimit) ||
+					ev.PeerCred == nil || ev.PeerCred.Pid != int32(os.Getpid()) {
+					t.Fatalf("event %s %v", ev.Type, ev.Err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("rejection not reported")
+			}
+			if stats := srv.ListenerStats(); stats != tc.stats {
+				t.Fatalf("stats %+v", stats)
+			}
+		})
+	}
+}
+
+// TestListenerLimitsRelease closes a pending peer, its slot must be
+// available to the next peer
+func TestListenerLimitsRelease(t *testing.T) {
+	file, srv := listeningSocket(t, WithListenerLimits(ListenerLimits{MaxPending: 1, MaxPerUid: 1, MaxPerPid: 1}))
+	r, msg := dialListener(t, file)
+	if msg.Type() != controlmsg.TypeHello {
+		t.Fatalf("first peer got %s", msg.Type())
+	}
+	r.close()
+	waitFor(t, "peer closed", func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return len(srv.ccs) == 0
+	})
+	_, msg = dialListener(t, file)
+	if msg.Type() != controlmsg.TypeHello {
+		t.Fatalf("peer after close got %s", msg.Type())
+	}
+	if stats := srv.ListenerStats(); stats != (ListenerStats{Accepted: 2}) {
+		t.Fatalf("stats %+v", stats)
+	}
+}
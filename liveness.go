@@ -0,0 +1,218 @@
+package zmemif
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/zartbot/zmemif/controlmsg"
+)
+
+// default liveness check interval
+const defaultLivenessInterval = time.Second
+
+// featureKeepalive peers answer msgTypeKeepalive with msgTypeAck
+const featureKeepalive = controlmsg.FeatureKeepalive
+
+// localFeatures are the zmemif extension features supported by this
+// implementation
+const localFeatures = featureKeepalive | featureDisconnectCodes
+
+// LivenessConfig enables detection of connected peers that stop
+// responding without closing the control channel. Every Interval the
+// port checks that the peer consumes the descriptors posted on tx
+// queues, and if the peer is a zmemif peer, that it answers a keepalive
+// on the control channel. A peer that fails the checks for
+// DegradedAfter marks the port degraded, see Port.IsDegraded, and for
+// DisconnectAfter disconnects the port with
+// DisconnectCodePeerUnresponsive. Both transitions are reported by
+// events, see WithEventFunc. Zero values select the defaults: one second
+// interval, degraded after three intervals, never disconnect.
+//
+// Ring progress is only a hint, a peer that doesn't read packets from its
+// rx queues is reported as unresponsive as well.
+type LivenessConfig struct {
+	Interval        time.Duration
+	DegradedAfter   time.Duration
+	DisconnectAfter time.Duration
+}
+
+func (lc *LivenessConfig) interval() time.Duration {
+	if lc.Interval <= 0 {
+		return defaultLivenessInterval
+	}
+	return lc.Interval
+}
+
+func (lc *LivenessConfig) degradedAfter() time.Duration {
+	if lc.DegradedAfter <= 0 {
+		return 3 * lc.interval()
+	}
+	return lc.DegradedAfter
+}
+
+// liveness is the state of the liveness check of a connected port
+type liveness struct {
+	timer        *time.Timer
+	session      uint64
+	lastCheck    time.Time
+	stalledSince time.Time // zero while the peer responds
+	peerIndex    []uint16  // ring index advanced by the peer per tx queue
+	consumed     []uint16  // ring index up to which the peer consumed descriptors per tx queue
+	keepalive    bool      // a keepalive was sent at the last check
+}
+
+// IsDegraded returns true if the liveness check found the peer of the
+// connected port unresponsive, see LivenessConfig. It is safe to call
+// from any goroutine.
+func (p *Port) IsDegraded() bool {
+	return p.degraded.Load()
+}
+
+// startLiveness starts the liveness check of a connected port, socket
+// lock must be held
+func (p *Port) startLiveness() {
+	p.stopLiveness()
+	if p.cfg.Liveness == nil {
+		return
+	}
+
+	l := &liveness{
+		session:   p.session.Load(),
+		lastCheck: time.Now(),
+		peerIndex: make([]uint16, len(p.txQueues)),
+		consumed:  make([]uint16, len(p.txQueues)),
+	}
+	for i := range p.txQueues {
+		l.peerIndex[i], l.consumed[i] = p.txQueues[i].peerProgress()
+	}
+	p.liveness = l
+	l.timer = time.AfterFunc(p.cfg.Liveness.interval(), func() {
+		p.checkLiveness(l)
+	})
+}
+
+// stopLiveness stops the liveness check, socket lock must be held
+func (p *Port) stopLiveness() {
+	if p.liveness != nil {
+		p.liveness.timer.Stop()
+		p.liveness = nil
+	}
+	p.degraded.Store(false)
+}
+
+// peerProgress returns the ring index advanced by the peer on a tx queue
+// and the index of the next descriptor posted to the peer
+func (q *Queue) peerProgress() (peer uint16, posted uint16) {
+	if q.port.cfg.IsServer {
+		// the client returns consumed buffers by advancing head
+		return uint16(q.readHead()), uint16(q.readTail())
+	}
+	// the server consumes packets by advancing tail
+	return uint16(q.readTail()), uint16(q.readHead())
+}
+
+// sendKeepalive sends a keepalive to zmemif peers and returns true if it
+// was sent, socket lock must be held
+func (p *Port) sendKeepalive() bool {
+	if p.cc.peerFeatures&featureKeepalive == 0 {
+		return false
+	}
+
+	err := p.cc.msgEnq(&controlmsg.Keepalive{}, -1)
+	if err == nil {
+		err = p.cc.sendMsg()
+	}
+	if err != nil {
+		p.socket.logger.Warn("failed to send keepalive", p.logArgs("error", err)...)
+	}
+	return true
+}
+
+// stalled returns the reason the peer failed the liveness checks since
+// the last check, or an empty string
+func (p *Port) stalled(l *liveness) (reason string, err error) {
+	if p.guardFaults {
+		defer p.recoverFault(guardFault(), &err)
+	}
+
+	for i := range p.txQueues {
+		peer, posted := p.txQueues[i].peerProgress()
+		if peer != l.peerIndex[i] {
+			l.peerIndex[i] = peer
+			// the server only learns that the client consumed
+			// descriptors, not how many
+			l.consumed[i] = posted
+			if !p.cfg.IsServer {
+				l.consumed[i] = peer
+			}
+			continue
+		}
+		pending := posted - l.consumed[i]
+		if err = p.txQueues[i].checkSlots(pending); err != nil {
+			return "", err
+		}
+		if pending > 0 && reason == "" {
+			reason = fmt.Sprintf("%d descriptors not consumed on tx queue %d", pending, i)
+		}
+	}
+	if reason == "" && l.keepalive && p.cc.lastRx.Before(l.lastCheck) {
+		reason = "no keepalive answer"
+	}
+	return reason, nil
+}
+
+// checkLiveness runs the liveness check and rearms its timer
+func (p *Port) checkLiveness(l *liveness) {
+	p.socket.mu.Lock()
+	defer p.socket.mu.Unlock()
+
+	if p.liveness != l || p.cc == nil || p.session.Load() != l.session {
+		return
+	}
+
+	now := time.Now()
+	reason, err := p.stalled(l)
+	if err != nil {
+		err = p.cc.close(true, fmt.Errorf("%w: %w", ErrProtocol, err))
+		if err != nil {
+			p.socket.reportError(fmt.Errorf("failed to disconnect port %s: %w", p.cfg.Name, err))
+		}
+		return
+	}
+	lc := p.cfg.Liveness
+
+	if reason == "" {
+		if p.degraded.Load() {
+			p.degraded.Store(false)
+			p.socket.logger.Info("peer recovered", p.logArgs()...)
+			p.socket.emit(Event{Type: EventPeerRecovered, Port: p, PeerCred: p.peerCred.Load()})
+		}
+		l.stalledSince = time.Time{}
+	} else {
+		if l.stalledSince.IsZero() {
+			l.stalledSince = l.lastCheck
+		}
+		stalled := now.Sub(l.stalledSince)
+
+		if lc.DisconnectAfter > 0 && stalled >= lc.DisconnectAfter {
+			reason := fmt.Errorf("%w: %s for %s", ErrPeerUnresponsive, reason, stalled.Round(time.Millisecond))
+			p.socket.logger.Warn("disconnecting unresponsive peer", p.logArgs("error", reason)...)
+			p.socket.emit(Event{Type: EventPeerUnresponsive, Port: p, PeerCred: p.peerCred.Load(), Err: reason})
+			err = p.cc.close(true, reason)
+			if err != nil {
+				p.socket.reportError(fmt.Errorf("failed to disconnect port %s: %w", p.cfg.Name, err))
+			}
+			return
+		}
+		if !p.degraded.Load() && stalled >= lc.degradedAfter() {
+			p.degraded.Store(true)
+			reason := fmt.Errorf("%w: %s for %s", ErrPeerUnresponsive, reason, stalled.Round(time.Millisecond))
+			p.socket.logger.Warn("peer degraded", p.logArgs("error", reason)...)
+			p.socket.emit(Event{Type: EventPeerDegraded, Port: p, PeerCred: p.peerCred.Load(), Err: reason})
+		}
+	}
+
+	l.lastCheck = now
+	l.keepalive = p.sendKeepalive()
+	l.timer.Reset(lc.interval())
+}
@@ -0,0 +1,105 @@
+package zmemif
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Logger is used by Socket and its ports to report events. Arguments
+// following the message are alternating key-value pairs, as in log/slog.
+// *slog.Logger satisfies this interface.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// nopLogger discards all log events, it is the default Logger
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, args ...interface{}) {}
+func (nopLogger) Info(msg string, args ...interface{})  {}
+func (nopLogger) Warn(msg string, args ...interface{})  {}
+func (nopLogger) Error(msg string, args ...interface{}) {}
+
+// NewSlogLogger returns a Logger writing to l. If l is nil
+// slog.Default() is used.
+func NewSlogLogger(l *slog.Logger) Logger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return l
+}
+
+// logrusLogger adapts logrus.FieldLogger to Logger
+type logrusLogger struct {
+	l logrus.FieldLogger
+}
+
+// NewLogrusLogger returns a Logger writing to l. Key-value pairs are
+// converted to logrus fields. If l is nil the standard logrus logger
+// is used.
+func NewLogrusLogger(l logrus.FieldLogger) Logger {
+	if l == nil {
+		l = logrus.StandardLogger()
+	}
+	return &logrusLogger{l: l}
+}
+
+// withFields converts key-value pairs to logrus fields
+func (ll *logrusLogger) withFields(args []interface{}) logrus.FieldLogger {
+	if len(args) == 0 {
+		return ll.l
+	}
+	fields := make(logrus.Fields, (len(args)+1)/2)
+	for i := 0; i < len(args); i += 2 {
+		key := fmt.Sprint(args[i])
+		if i+1 < len(args) {
+			fields[key] = args[i+1]
+		} else {
+			fields["!BADKEY"] = args[i]
+		}
+	}
+	return ll.l.WithFields(fields)
+}
+
+func (ll *logrusLogger) Debug(msg string, args ...interface{}) {
+	ll.withFields(args).Debug(msg)
+}
+
+func (ll *logrusLogger) Info(msg string, args ...interface{}) {
+	ll.withFields(args).Info(msg)
+}
+
+func (ll *logrusLogger) Warn(msg string, args ...interface{}) {
+	ll.withFields(args).Warn(msg)
+}
+
+func (ll *logrusLogger) Error(msg string, args ...interface{}) {
+	ll.withFields(args).Error(msg)
+}
+
+// logArgs returns the sockets log fields followed by args
+func (socket *Socket) logArgs(args ...interface{}) []interface{} {
+	return append([]interface{}{"socket", socket.filename}, args...)
+}
+
+// logArgs returns the ports log fields followed by args
+func (p *Port) logArgs(args ...interface{}) []interface{} {
+	return p.socket.logArgs(append([]interface{}{
+		"port_id", p.cfg.Id,
+		"port_name", p.cfg.Name,
+		"role", RoleToString(p.cfg.IsServer),
+	}, args...)...)
+}
+
+// logArgs returns the control channels log fields followed by args
+func (cc *controlChannel) logArgs(args ...interface{}) []interface{} {
+	if cc.port != nil {
+		return cc.port.logArgs(args...)
+	}
+	return cc.socket.logArgs(append([]interface{}{"fd", cc.event.Fd}, args...)...)
+}
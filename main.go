@@ -1,10 +1,11 @@
 package zmemif
 
 import (
-	"container/list"
 	"fmt"
 	"sync"
-	"syscall"
+	"sync/atomic"
+
+	"github.com/zartbot/zmemif/controlmsg"
 )
 
 const (
@@ -14,87 +15,126 @@ const (
 	DefaultPacketBufferSize = 2048
 )
 
-type portMode uint8
+// PortMode is the interface mode requested by the client in MsgInit
+type PortMode = controlmsg.Mode
 
 const (
-	portModeEthernet portMode = iota
-	portModeIp
-	portModePuntInject
+	PortModeEthernet   = controlmsg.ModeEthernet
+	PortModeIp         = controlmsg.ModeIp
+	PortModePuntInject = controlmsg.ModePuntInject
 )
 
+const mfd_cloexec = 1
 const mfd_allow_sealing = 2
+const mfd_hugetlb = 4
+const mfd_huge_shift = 26
 const sys_memfd_create = 319
 const f_add_seals = 1033
+const f_get_seals = 1034
 const f_seal_shrink = 0x0002
 
 const efd_nonblock = 04000
 
 // Port represents memif network interface
 type Port struct {
-	cfg        PortCfg
-	run        MemoryConfig
-	ExtendData interface{}
-	listRef    *list.Element
-	socket     *Socket
-	cc         *controlChannel
-	remoteName string
-	peerName   string
-	regions    []memoryRegion
-	txQueues   []Queue
-	rxQueues   []Queue
-	ErrChan    chan error
-	QuitChan   chan struct{}
-	Wg         sync.WaitGroup
+	cfg           PortCfg
+	run           MemoryConfig
+	ExtendData    interface{}
+	socket        *Socket
+	cc            *controlChannel
+	linkState     atomic.Uint32
+	remoteName    string
+	peerName      string
+	disconnectErr atomic.Pointer[DisconnectError]
+	peerCred      atomic.Pointer[PeerCred]
+	autoDelete    bool // created by PortFactory, deleted on disconnect
+	peerLimits    PeerLimits
+	negotiation   atomic.Pointer[Negotiation]
+	session       atomic.Uint64 // incremented on every connect
+	invalidSess   atomic.Uint64 // last session disconnected by disconnectInvalid
+	invalidDescs  atomic.Uint64
+	guardFaults   bool           // a region is not sealed, see checkRegionFd
+	callback      bool           // a callback runs with the socket unlocked, see Socket.unlocked
+	pendingDc     bool           // disconnected while a callback ran, see Port.disconnect
+	running       bool           // ConnectedFunc was called, DisconnectedFunc is due
+	handlers      sync.WaitGroup // queue handlers running, see Poller.AddQueue
+	liveness      *liveness
+	degraded      atomic.Bool
+	regions       []memoryRegion
+	txQueues      []Queue
+	rxQueues      []Queue
+	ErrChan       chan error
+	QuitChan      chan struct{}
+	Wg            sync.WaitGroup
 }
 
-// ConnectedFunc is a callback called when an interface is connected
+// ConnectedFunc is a callback called when an interface is connected. It
+// runs with the socket unlocked and may call Socket and Port methods.
 type ConnectedFunc func(p *Port) error
 
-// DisconnectedFunc is a callback called when an interface is disconnected
+// DisconnectedFunc is a callback called when an interface is
+// disconnected after ConnectedFunc was called, failed handshakes don't
+// call it. It runs with the socket unlocked, the socket waits for
+// Port.Wg afterwards, so workers may call Socket and Port methods while
+// they stop.
 type DisconnectedFunc func(p *Port) error
 
 // MemoryConfig represents shared memory configuration
 type MemoryConfig struct {
-	NumQueuePairs    uint16 // number of queue pairs
+	NumQueuePairs    uint16 // number of queue pairs, default for NumTxQueues and NumRxQueues
+	NumTxQueues      uint16 // number of tx queues
+	NumRxQueues      uint16 // number of rx queues
 	Log2RingSize     uint8  // ring size as log2
 	PacketBufferSize uint32 // size of single packet buffer
 }
 
 // PortCfg represent port configuration
 type PortCfg struct {
-	Id               uint32 // Port identifier unique across socket. Used to identify peer Port when connecting
-	IsServer         bool   // Port role server/client
-	Name             string
-	Secret           [24]byte // optional parameter, secrets of the Ports must match if they are to connect
-	MemoryConfig     MemoryConfig
-	ConnectedFunc    ConnectedFunc    // callback called when Port changes status to connected
-	DisconnectedFunc DisconnectedFunc // callback called when Port changes status to disconnected
-	ExtendData       interface{}      // ExtendData used by client program
+	Id                uint32 // Port identifier unique across socket. Used to identify peer Port when connecting
+	IsServer          bool   // Port role server/client
+	Name              string
+	RemotePortName    string             // optional, client requests the server Port by name instead of Id, zmemif servers only
+	Secret            [24]byte           // optional parameter, secrets of the Ports must match if they are to connect
+	SecretProvider    SecretProvider     // optional, secrets accepted by server Port, overrides Secret
+	PeerCredPolicy    *PeerCredPolicy    // optional, processes allowed to connect to server Port
+	NegotiationPolicy *NegotiationPolicy // optional, shared memory limits of server Port, overrides the sockets policy
+	MemoryConfig      MemoryConfig
+	HugePages         HugePageConfig   // optional, hugepages backing regions created by client Port
+	Layout            MemoryLayout     // optional, distribution of rings and buffers across regions created by client Port
+	Liveness          *LivenessConfig  // optional, detection of unresponsive peers
+	ConnectedFunc     ConnectedFunc    // callback called when Port changes status to connected
+	DisconnectedFunc  DisconnectedFunc // callback called when Port changes status to disconnected
+	ExtendData        interface{}      // ExtendData used by client program
+
+	// DisconnectOnInvalidDescriptor disconnects the Port when the peer places
+	// a descriptor or ring position out of bounds, see Port.InvalidDescriptors
+	DisconnectOnInvalidDescriptor bool
 }
 
 // NewSocket returns a new Socket
-func NewSocket(appName string, filename string) (socket *Socket, err error) {
+func NewSocket(appName string, filename string, opts ...SocketOption) (socket *Socket, err error) {
 	socket = &Socket{
 		appName:  appName,
 		filename: filename,
-		portList: list.New(),
-		ccList:   list.New(),
+		ports:    make(map[portKey]*Port),
+		ccs:      make(map[int32]*controlChannel),
+		logger:   nopLogger{},
+		fileCfg:  socketFileCfg{uid: -1, gid: -1},
 		ErrChan:  make(chan error, 1),
 	}
 	if socket.filename == "" {
 		socket.filename = DefaultSocketFilename
 	}
-
-	socket.epfd, _ = syscall.EpollCreate1(0)
-
-	efd, _ := eventFd()
-	socket.wakeEvent = syscall.EpollEvent{
-		Events: syscall.EPOLLIN | syscall.EPOLLERR | syscall.EPOLLHUP,
-		Fd:     int32(efd),
+	for _, opt := range opts {
+		opt(socket)
 	}
-	err = socket.addEvent(&socket.wakeEvent)
-	if err != nil {
-		return nil, fmt.Errorf("failed to add event: %v", err)
+
+	if socket.poller == nil {
+		socket.poller, err = newPoller(socket.ErrChan)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create poller: %v", err)
+		}
+		socket.ownPoller = true
 	}
 
 	return socket, nil
@@ -104,13 +144,13 @@ func NewPort(socket *Socket, cfg *PortCfg, extendData interface{}) (*Port, error
 	port, err := socket.NewPort(cfg)
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to create interface on socket %s: %s", socket.GetFilename(), err)
+		return nil, fmt.Errorf("failed to create interface on socket %s: %w", socket.GetFilename(), err)
 	}
 
 	// client attempts to connect to control socket
 	// to handle control communication call socket.StartPolling()
 	if !port.IsServer() {
-		fmt.Println(cfg.Name, ": Connecting to control socket...")
+		socket.logger.Info("connecting to control socket", port.logArgs()...)
 		for !port.IsConnecting() {
 			err = port.RequestConnection()
 			if err != nil {
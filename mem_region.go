@@ -16,31 +16,113 @@ type memoryRegion struct {
 }
 
 // memfdCreate returns memory file file descriptor (memif.sys_memfd_create)
-func memfdCreate() (mfd int, err error) {
-	p0, err := syscall.BytePtrFromString("memif_region_0")
+func memfdCreate(name string, flags int) (mfd int, err error) {
+	p0, err := syscall.BytePtrFromString(name)
 	if err != nil {
 		return -1, fmt.Errorf("memfdCreate: %s", err)
 	}
 
-	u_mfd, _, errno := syscall.Syscall(sys_memfd_create, uintptr(unsafe.Pointer(p0)), uintptr(mfd_allow_sealing), uintptr(0))
+	u_mfd, _, errno := syscall.Syscall(sys_memfd_create, uintptr(unsafe.Pointer(p0)), uintptr(flags|mfd_cloexec), uintptr(0))
 	if errno != 0 {
-		return -1, fmt.Errorf("memfdCreate: %s", os.NewSyscallError("memfd_create", errno))
+		return -1, fmt.Errorf("memfdCreate: %w", os.NewSyscallError("memfd_create", errno))
 	}
 
 	return int(u_mfd), nil
 }
 
+// MemoryLayout selects how a client port distributes rings and packet
+// buffers across memory regions. By default region 0 holds all rings
+// followed by all packet buffers.
+type MemoryLayout struct {
+	SeparateRings  bool   // region 0 holds rings only, packet buffers are in region 1
+	RegionPerQueue bool   // region 0 holds rings only, region 1+i holds buffers of tx and rx queue i
+	ExtraBuffers   uint32 // number of extra packet buffers in an additional last region
+}
+
+// numBufferRegions returns the number of regions holding ring buffers
+func (l *MemoryLayout) numBufferRegions(mc *MemoryConfig) int {
+	if l.RegionPerQueue {
+		return int(max(mc.NumTxQueues, mc.NumRxQueues))
+	}
+	if l.SeparateRings {
+		return 1
+	}
+	return 0
+}
+
 // initializeRegions initializes port regions (client only)
 func (p *Port) initializeRegions() (err error) {
-
-	err = p.addRegion(true, true)
+	layout := &p.cfg.Layout
+	ringBuffers := int(p.run.NumTxQueues+p.run.NumRxQueues) << p.run.Log2RingSize
+
+	switch {
+	case layout.RegionPerQueue:
+		err = p.addRegion(true, 0)
+		for qid := 0; err == nil && qid < layout.numBufferRegions(&p.run); qid++ {
+			n := 0
+			if qid < int(p.run.NumTxQueues) {
+				n++
+			}
+			if qid < int(p.run.NumRxQueues) {
+				n++
+			}
+			err = p.addRegion(false, n<<p.run.Log2RingSize)
+		}
+	case layout.SeparateRings:
+		err = p.addRegion(true, 0)
+		if err == nil {
+			err = p.addRegion(false, ringBuffers)
+		}
+	default:
+		err = p.addRegion(true, ringBuffers)
+	}
+	if err == nil && layout.ExtraBuffers > 0 {
+		err = p.addRegion(false, int(layout.ExtraBuffers))
+	}
 	if err != nil {
-		return fmt.Errorf("initializeRegions: %s", err)
+		return fmt.Errorf("initializeRegions: %w", err)
 	}
 
 	return nil
 }
 
+// queueBuffers returns the region and offset of the first packet buffer
+// of a queue (client only)
+func (p *Port) queueBuffers(ringType ringType, qid int) (region int, offset uint32) {
+	ringBuffersSize := p.run.PacketBufferSize << p.run.Log2RingSize
+
+	// tx buffers are followed by rx buffers
+	block := qid
+	if ringType == ringTypeM2S {
+		block += int(p.run.NumTxQueues)
+	}
+
+	switch {
+	case p.cfg.Layout.RegionPerQueue:
+		region = 1 + qid
+		block = 0
+		if ringType == ringTypeM2S && qid < int(p.run.NumTxQueues) {
+			block = 1
+		}
+	case p.cfg.Layout.SeparateRings:
+		region = 1
+	}
+
+	return region, p.regions[region].packetBufferOffset + uint32(block)*ringBuffersSize
+}
+
+// GetExtraBuffer returns the extra packet buffer i in shared memory, see
+// MemoryLayout.ExtraBuffers (client only). The buffer is valid while
+// the port is connected.
+func (p *Port) GetExtraBuffer(i int) ([]byte, error) {
+	if p.cfg.IsServer || i < 0 || i >= int(p.cfg.Layout.ExtraBuffers) || len(p.regions) == 0 {
+		return nil, fmt.Errorf("invalid extra buffer index %d", i)
+	}
+	r := &p.regions[len(p.regions)-1]
+	offset := int(r.packetBufferOffset) + i*int(p.run.PacketBufferSize)
+	return r.data[offset : offset+int(p.run.PacketBufferSize)], nil
+}
+
 // initializeQueues initializes port queues (client only)
 func (p *Port) initializeQueues() (err error) {
 	var q *Queue
@@ -49,10 +131,9 @@ func (p *Port) initializeQueues() (err error) {
 
 	desc = newDescBuf()
 	desc.setFlags(0)
-	desc.setRegion(0)
 	desc.setLength(int(p.run.PacketBufferSize))
 
-	for qid := 0; qid < int(p.run.NumQueuePairs); qid++ {
+	for qid := 0; qid < int(p.run.NumTxQueues); qid++ {
 		/* TX */
 		q = &Queue{
 			ring:     p.newRing(0, ringTypeS2M, qid),
@@ -69,13 +150,14 @@ func (p *Port) initializeQueues() (err error) {
 		q.putRing()
 		p.txQueues = append(p.txQueues, *q)
 
-		for j := 0; j < q.ring.size; j++ {
-			slot = qid*q.ring.size + j
-			desc.setOffset(int(p.regions[0].packetBufferOffset + uint32(slot)*p.run.PacketBufferSize))
+		region, offset := p.queueBuffers(ringTypeS2M, qid)
+		desc.setRegion(region)
+		for slot = 0; slot < q.ring.size; slot++ {
+			desc.setOffset(int(offset + uint32(slot)*p.run.PacketBufferSize))
 			q.putDescBuf(slot, desc)
 		}
 	}
-	for qid := 0; qid < int(p.run.NumQueuePairs); qid++ {
+	for qid := 0; qid < int(p.run.NumRxQueues); qid++ {
 		/* RX */
 		q = &Queue{
 			ring:     p.newRing(0, ringTypeM2S, qid),
@@ -92,9 +174,10 @@ func (p *Port) initializeQueues() (err error) {
 		q.putRing()
 		p.rxQueues = append(p.rxQueues, *q)
 
-		for j := 0; j < q.ring.size; j++ {
-			slot = qid*q.ring.size + j
-			desc.setOffset(int(p.regions[0].packetBufferOffset + uint32(slot)*p.run.PacketBufferSize))
+		region, offset := p.queueBuffers(ringTypeM2S, qid)
+		desc.setRegion(region)
+		for slot = 0; slot < q.ring.size; slot++ {
+			desc.setOffset(int(offset + uint32(slot)*p.run.PacketBufferSize))
 			q.putDescBuf(slot, desc)
 		}
 	}
@@ -102,43 +185,32 @@ func (p *Port) initializeQueues() (err error) {
 	return nil
 }
 
-// addRegions creates and adds a new memory region to the interface (client only)
-func (p *Port) addRegion(hasPacketBuffers bool, hasRings bool) (err error) {
+// ringsSize returns the size of all rings described by mc
+func ringsSize(mc *MemoryConfig) uint64 {
+	return (uint64(mc.NumTxQueues) + uint64(mc.NumRxQueues)) * uint64(ringSize+descSize*(1<<mc.Log2RingSize))
+}
+
+// buffersSize returns the size of all packet buffers described by mc
+func buffersSize(mc *MemoryConfig) uint64 {
+	return (uint64(mc.NumTxQueues) + uint64(mc.NumRxQueues)) * uint64(mc.PacketBufferSize) * (1 << mc.Log2RingSize)
+}
+
+// addRegions creates and adds a new memory region holding all rings if
+// hasRings is true, followed by numBuffers packet buffers (client only)
+func (p *Port) addRegion(hasRings bool, numBuffers int) (err error) {
 	var r memoryRegion
 
 	if hasRings {
-		r.packetBufferOffset = uint32((p.run.NumQueuePairs + p.run.NumQueuePairs) * (ringSize + descSize*(1<<p.run.Log2RingSize)))
+		r.packetBufferOffset = uint32(ringsSize(&p.run))
 	} else {
 		r.packetBufferOffset = 0
 	}
 
-	if hasPacketBuffers {
-		r.size = uint64(r.packetBufferOffset + p.run.PacketBufferSize*uint32(1<<p.run.Log2RingSize)*uint32(p.run.NumQueuePairs+p.run.NumQueuePairs))
-	} else {
-		r.size = uint64(r.packetBufferOffset)
-	}
-
-	r.fd, err = memfdCreate()
-	if err != nil {
-		return err
-	}
-
-	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(r.fd), uintptr(f_add_seals), uintptr(f_seal_shrink))
-	if errno != 0 {
-		syscall.Close(r.fd)
-		return fmt.Errorf("memfdCreate: %s", os.NewSyscallError("fcntl", errno))
-	}
-
-	err = syscall.Ftruncate(r.fd, int64(r.size))
-	if err != nil {
-		syscall.Close(r.fd)
-		r.fd = -1
-		return fmt.Errorf("memfdCreate: %s", err)
-	}
+	r.size = uint64(r.packetBufferOffset) + uint64(numBuffers)*uint64(p.run.PacketBufferSize)
 
-	r.data, err = syscall.Mmap(r.fd, 0, int(r.size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	err = p.allocRegion(&r, len(p.regions))
 	if err != nil {
-		return fmt.Errorf("addRegion: %s", err)
+		return fmt.Errorf("addRegion: %w", err)
 	}
 
 	p.regions = append(p.regions, r)
@@ -0,0 +1,248 @@
+package zmemif
+
+import (
+	"fmt"
+
+	"github.com/zartbot/zmemif/controlmsg"
+)
+
+// default limits advertised by servers without NegotiationPolicy
+const (
+	defaultMaxRegions      = 256
+	defaultMaxRings        = 256
+	defaultMaxLog2RingSize = 14
+)
+
+// NegotiationPolicy limits the shared memory a client may set up on a
+// server port. The limits are advertised in MsgHello and enforced when
+// regions and rings are added. Zero values select the defaults: 256
+// regions, 256 rings per direction, log2 ring size 14 and no limit on
+// region and total memory size. Only the sockets policy is advertised,
+// MsgHello is sent before the client names the port it connects to.
+// Regions not sealed against shrinking, including regions backed by
+// files other than memfds, are accepted unless RequireSeals is set.
+// Regions backed by hugetlbfs files (HugePageConfig.Path) can't be
+// sealed.
+type NegotiationPolicy struct {
+	MaxRegions      uint16 // maximum number of regions
+	MaxRingsS2M     uint16 // maximum number of client to server rings
+	MaxRingsM2S     uint16 // maximum number of server to client rings
+	MaxLog2RingSize uint8  // maximum ring size as log2
+	MaxRegionSize   uint64 // maximum size of a single region in bytes
+	MaxTotalMemory  uint64 // maximum size of all regions in bytes
+	RequireSeals    bool   // refuse regions not sealed against shrinking and files other than memfds
+}
+
+func (np *NegotiationPolicy) maxRegions() uint16 {
+	if np == nil || np.MaxRegions == 0 {
+		return defaultMaxRegions
+	}
+	return np.MaxRegions
+}
+
+func (np *NegotiationPolicy) maxRingsS2M() uint16 {
+	if np == nil || np.MaxRingsS2M == 0 {
+		return defaultMaxRings
+	}
+	return np.MaxRingsS2M
+}
+
+func (np *NegotiationPolicy) maxRingsM2S() uint16 {
+	if np == nil || np.MaxRingsM2S == 0 {
+		return defaultMaxRings
+	}
+	return np.MaxRingsM2S
+}
+
+func (np *NegotiationPolicy) maxLog2RingSize() uint8 {
+	if np == nil || np.MaxLog2RingSize == 0 {
+		return defaultMaxLog2RingSize
+	}
+	return np.MaxLog2RingSize
+}
+
+// hello fills the limits advertised in MsgHello. The message carries
+// the highest allowed index for regions and rings.
+func (np *NegotiationPolicy) hello(hello *MsgHello) {
+	hello.MaxRegion = np.maxRegions() - 1
+	hello.MaxRingS2M = np.maxRingsS2M() - 1
+	hello.MaxRingM2S = np.maxRingsM2S() - 1
+	hello.MaxLog2RingSize = min(np.maxLog2RingSize(), maxLog2RingSize)
+}
+
+// negotiationPolicy returns the policy applied to the port
+func (p *Port) negotiationPolicy() *NegotiationPolicy {
+	if p.cfg.NegotiationPolicy != nil {
+		return p.cfg.NegotiationPolicy
+	}
+	return p.socket.negotiationPolicy
+}
+
+// checkRegion verifies that a region of size can be added to the port
+func (p *Port) checkRegion(index uint16, size uint64) error {
+	np := p.negotiationPolicy()
+
+	if index >= np.maxRegions() {
+		return fmt.Errorf("%w: region index %d, max %d regions", ErrLimitExceeded, index, np.maxRegions())
+	}
+	if np != nil && np.MaxRegionSize != 0 && size > np.MaxRegionSize {
+		return fmt.Errorf("%w: region size %d, max %d", ErrLimitExceeded, size, np.MaxRegionSize)
+	}
+	if np != nil && np.MaxTotalMemory != 0 {
+		total := size
+		for _, r := range p.regions {
+			total += r.size
+		}
+		if total > np.MaxTotalMemory {
+			return fmt.Errorf("%w: total memory %d, max %d", ErrLimitExceeded, total, np.MaxTotalMemory)
+		}
+	}
+
+	return nil
+}
+
+// checkRing verifies that a ring can be added to the port
+func (p *Port) checkRing(ringType ringType, index uint16, log2Size uint8) error {
+	np := p.negotiationPolicy()
+
+	max := np.maxRingsS2M()
+	if ringType == ringTypeM2S {
+		max = np.maxRingsM2S()
+	}
+	if index >= max {
+		return fmt.Errorf("%w: ring index %d, max %d rings", ErrLimitExceeded, index, max)
+	}
+	if log2Size > np.maxLog2RingSize() {
+		return fmt.Errorf("%w: log2 ring size %d, max %d", ErrLimitExceeded, log2Size, np.maxLog2RingSize())
+	}
+
+	return nil
+}
+
+// maxLog2RingSize is the largest ring supported by the 16 bit ring head
+// and tail
+const maxLog2RingSize = controlmsg.MaxLog2RingSize
+
+// maxRegionSize is the largest region addressable by 32 bit descriptor
+// offsets
+const maxRegionSize = 1 << 32
+
+// validateMemoryConfig rejects memory configurations that can't be
+// set up
+func validateMemoryConfig(mc *MemoryConfig, layout *MemoryLayout) error {
+	if mc.Log2RingSize > maxLog2RingSize {
+		return fmt.Errorf("%w: log2 ring size %d exceeds %d", ErrInvalidConfig, mc.Log2RingSize, maxLog2RingSize)
+	}
+	if mc.PacketBufferSize&(mc.PacketBufferSize-1) != 0 {
+		return fmt.Errorf("%w: packet buffer size %d is not a power of two", ErrInvalidConfig, mc.PacketBufferSize)
+	}
+	size := ringsSize(mc) + buffersSize(mc)
+	if size > maxRegionSize {
+		return fmt.Errorf("%w: region size %d exceeds 4GB", ErrInvalidConfig, size)
+	}
+	size = uint64(layout.ExtraBuffers) * uint64(mc.PacketBufferSize)
+	if size > maxRegionSize {
+		return fmt.Errorf("%w: extra buffer region size %d exceeds 4GB", ErrInvalidConfig, size)
+	}
+	return nil
+}
+
+// NegotiationSide tells which side limited a negotiated value
+type NegotiationSide uint8
+
+const (
+	NegotiationSideNone  NegotiationSide = iota // requested value is used
+	NegotiationSideLocal                        // limited by the local NegotiationPolicy
+	NegotiationSidePeer                         // limited by the peer
+)
+
+func (side NegotiationSide) String() string {
+	switch side {
+	case NegotiationSideNone:
+		return "none"
+	case NegotiationSideLocal:
+		return "local"
+	case NegotiationSidePeer:
+		return "peer"
+	}
+	return fmt.Sprintf("NegotiationSide(%d)", uint8(side))
+}
+
+// PeerLimits holds the limits advertised by the server in MsgHello
+type PeerLimits struct {
+	MaxRegions      int
+	MaxRingsS2M     int
+	MaxRingsM2S     int
+	MaxLog2RingSize uint8
+}
+
+// NegotiatedValue describes the negotiation of a MemoryConfig field
+type NegotiatedValue struct {
+	Field     string
+	Requested uint64
+	Effective uint64
+	LimitedBy NegotiationSide
+}
+
+// Negotiation reports how the memory configuration of a connected port
+// was negotiated
+type Negotiation struct {
+	Requested  MemoryConfig
+	Effective  MemoryConfig
+	PeerLimits *PeerLimits // advertised by the server, nil for server ports
+	Values     []NegotiatedValue
+}
+
+// Negotiation returns the negotiation report of the last connection, or
+// nil if the port has not been connected yet. It is safe to call from
+// any goroutine.
+func (p *Port) Negotiation() *Negotiation {
+	return p.negotiation.Load()
+}
+
+// newNegotiation builds the negotiation report once the port is
+// connected. Client values can only be limited by the server, server
+// values are limited by the local policy or chosen by the client.
+func (p *Port) newNegotiation() *Negotiation {
+	n := &Negotiation{
+		Requested: p.cfg.MemoryConfig,
+		Effective: p.run,
+	}
+	np := p.negotiationPolicy()
+	if !p.cfg.IsServer {
+		pl := p.peerLimits
+		n.PeerLimits = &pl
+	}
+
+	value := func(field string, requested, effective, localLimit uint64) {
+		v := NegotiatedValue{
+			Field:     field,
+			Requested: requested,
+			Effective: effective,
+		}
+		if effective < requested {
+			v.LimitedBy = NegotiationSidePeer
+			if p.cfg.IsServer && effective >= localLimit {
+				v.LimitedBy = NegotiationSideLocal
+			}
+		}
+		n.Values = append(n.Values, v)
+	}
+	value("NumTxQueues", uint64(n.Requested.NumTxQueues), uint64(n.Effective.NumTxQueues), uint64(np.maxRingsM2S()))
+	value("NumRxQueues", uint64(n.Requested.NumRxQueues), uint64(n.Effective.NumRxQueues), uint64(np.maxRingsS2M()))
+	value("Log2RingSize", uint64(n.Requested.Log2RingSize), uint64(n.Effective.Log2RingSize), uint64(np.maxLog2RingSize()))
+	value("PacketBufferSize", uint64(n.Requested.PacketBufferSize), uint64(n.Effective.PacketBufferSize), 0)
+
+	return n
+}
+
+// logNegotiation warns about configured values that were reduced
+func (p *Port) logNegotiation(n *Negotiation) {
+	for _, v := range n.Values {
+		if v.LimitedBy == NegotiationSideNone {
+			continue
+		}
+		p.socket.logger.Warn("memory config clamped", p.logArgs("field", v.Field,
+			"requested", v.Requested, "effective", v.Effective, "limited_by", v.LimitedBy)...)
+	}
+}
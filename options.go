@@ -0,0 +1,127 @@
+package zmemif
+
+import "os"
+
+// SocketOption configures optional Socket behaviour, see NewSocket
+type SocketOption func(socket *Socket)
+
+// WithLogger sets the Logger used by the socket and its ports. By default
+// nothing is logged.
+func WithLogger(l Logger) SocketOption {
+	return func(socket *Socket) {
+		if l == nil {
+			l = nopLogger{}
+		}
+		socket.logger = l
+	}
+}
+
+// WithSecretProvider sets the SecretProvider used by server ports that
+// don't have their own PortCfg.SecretProvider
+func WithSecretProvider(provider SecretProvider) SocketOption {
+	return func(socket *Socket) {
+		socket.secretProvider = provider
+	}
+}
+
+// WithPeerCredPolicy sets the policy applied to every connection accepted
+// by the listener, before the peer is sent a Hello. Server ports can
+// restrict access further with PortCfg.PeerCredPolicy.
+func WithPeerCredPolicy(policy *PeerCredPolicy) SocketOption {
+	return func(socket *Socket) {
+		socket.peerCredPolicy = policy
+	}
+}
+
+// WithEventFunc sets the callback receiving socket and port events
+func WithEventFunc(fn EventFunc) SocketOption {
+	return func(socket *Socket) {
+		socket.eventFunc = fn
+	}
+}
+
+// WithTraceFunc sets the callback receiving every control message sent
+// or received by the socket, see NewLogTracer and NewJSONTracer
+func WithTraceFunc(fn TraceFunc) SocketOption {
+	return func(socket *Socket) {
+		socket.traceFunc = fn
+	}
+}
+
+// WithFileMode sets the permissions of the socket file created by the
+// listener. They are applied before the socket starts accepting
+// connections.
+func WithFileMode(mode os.FileMode) SocketOption {
+	return func(socket *Socket) {
+		socket.fileCfg.mode = mode
+		socket.fileCfg.setMode = true
+	}
+}
+
+// WithFileOwner sets the owner and group of the socket file created by
+// the listener. An id of -1 leaves it unchanged.
+func WithFileOwner(uid int, gid int) SocketOption {
+	return func(socket *Socket) {
+		socket.fileCfg.uid = uid
+		socket.fileCfg.gid = gid
+	}
+}
+
+// WithCreateDir makes the listener create missing parent directories of
+// the socket file with permissions perm
+func WithCreateDir(perm os.FileMode) SocketOption {
+	return func(socket *Socket) {
+		socket.fileCfg.createDir = true
+		socket.fileCfg.dirPerm = perm
+	}
+}
+
+// WithRemoveStale makes the listener remove an existing socket file
+// before binding, if no process is listening on it anymore
+func WithRemoveStale() SocketOption {
+	return func(socket *Socket) {
+		socket.fileCfg.removeStale = true
+	}
+}
+
+// WithNegotiationPolicy sets the NegotiationPolicy advertised to clients
+// and applied to server ports that don't have their own
+// PortCfg.NegotiationPolicy
+func WithNegotiationPolicy(np *NegotiationPolicy) SocketOption {
+	return func(socket *Socket) {
+		socket.negotiationPolicy = np
+	}
+}
+
+// WithPortFactory sets the PortFactory used to create server ports
+// for unknown ids
+func WithPortFactory(f PortFactory) SocketOption {
+	return func(socket *Socket) {
+		socket.portFactory = f
+	}
+}
+
+// WithHandshakeTimeouts sets the time peers may take to complete the
+// memif handshake
+func WithHandshakeTimeouts(t HandshakeTimeouts) SocketOption {
+	return func(socket *Socket) {
+		socket.handshakeTimeouts = t
+	}
+}
+
+// WithListenerLimits limits the control channels accepted by the
+// listener
+func WithListenerLimits(limits ListenerLimits) SocketOption {
+	return func(socket *Socket) {
+		socket.listenerLimits = limits
+	}
+}
+
+// WithPoller makes the socket use a shared poller instead of owning
+// one. The caller is responsible for starting and stopping the poller,
+// StartPolling and StopPolling have no effect on such sockets.
+func WithPoller(poller *Poller) SocketOption {
+	return func(socket *Socket) {
+		socket.poller = poller
+	}
+}
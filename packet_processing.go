@@ -1,10 +1,13 @@
 package zmemif
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+)
 
 // ReadPacket reads one packet form the shared memory and
 // returns the number of bytes read
-func (q *Queue) ReadPacket(pkt []byte) (int, error) {
+func (q *Queue) ReadPacket(pkt []byte) (n int, err error) {
 	var mask int = q.ring.size - 1
 	var slot int
 	var lastSlot int
@@ -14,6 +17,10 @@ func (q *Queue) ReadPacket(pkt []byte) (int, error) {
 	var nSlots uint16
 	var desc descBuf = newDescBuf()
 
+	if q.port.guardFaults {
+		defer q.recoverFault(guardFault(), &n, &err)
+	}
+
 	if q.port.cfg.IsServer {
 		slot = int(q.lastHead)
 		lastSlot = q.readHead()
@@ -26,32 +33,41 @@ func (q *Queue) ReadPacket(pkt []byte) (int, error) {
 	if nSlots == 0 {
 		goto refill
 	}
+	err = q.checkSlots(nSlots)
+	if err != nil {
+		return 0, err
+	}
 
-	// copy descriptor from shm
-	q.getDescBuf(slot&mask, desc)
-	length = desc.getLength()
-	offset = desc.getOffset()
-
-	copy(pkt[:], q.port.regions[desc.getRegion()].data[offset:offset+length])
-	pktOffset += length
-
-	slot++
-	nSlots--
-
-	for (desc.getFlags() & descFlagNext) == descFlagNext {
-		if nSlots == 0 {
-			return 0, fmt.Errorf("incomplete chained buffer, may suggest peer error")
-		}
-
+	for {
+		// copy descriptor from shm
 		q.getDescBuf(slot&mask, desc)
 		length = desc.getLength()
 		offset = desc.getOffset()
 
-		copy(pkt[pktOffset:], q.port.regions[desc.getRegion()].data[offset:offset+length])
-		pktOffset += length
+		// after an error the rest of the chain is consumed and dropped
+		if err == nil {
+			err = q.checkDesc(desc, length)
+		}
+		if err == nil && pktOffset+length > len(pkt) {
+			err = fmt.Errorf("%w: packet exceeds %d bytes", io.ErrShortBuffer, len(pkt))
+		}
+		if err == nil {
+			copy(pkt[pktOffset:], q.port.regions[desc.getRegion()].data[offset:offset+length])
+			pktOffset += length
+		}
 
 		slot++
 		nSlots--
+
+		if (desc.getFlags() & descFlagNext) != descFlagNext {
+			break
+		}
+		if nSlots == 0 {
+			if err != nil {
+				return 0, err
+			}
+			return 0, fmt.Errorf("%w, may suggest peer error", ErrIncompleteChain)
+		}
 	}
 
 refill:
@@ -70,17 +86,29 @@ refill:
 		q.writeHead(head)
 	}
 
+	if err != nil {
+		return 0, err
+	}
 	return pktOffset, nil
 }
 
 // WritePacket writes one packet to the shared memory and
-// returns the number of bytes written
-func (q *Queue) WritePacket(pkt []byte) int {
+// returns the number of bytes written. A packet larger than a
+// buffer is chained over several descriptors. ErrRingFull is
+// returned if there are not enough free slots to hold the packet.
+//
+// WritePacket used to return only the number of bytes written,
+// with zero for a full ring. Callers must check the error now.
+func (q *Queue) WritePacket(pkt []byte) (n int, err error) {
 	var mask int = q.ring.size - 1
 	var slot int
 	var nFree uint16
 	var packetBufferSize int = int(q.port.run.PacketBufferSize)
 
+	if q.port.guardFaults {
+		defer q.recoverFault(guardFault(), &n, &err)
+	}
+
 	if q.port.cfg.IsServer {
 		slot = q.readTail()
 		nFree = uint16(q.readHead() - slot)
@@ -91,7 +119,11 @@ func (q *Queue) WritePacket(pkt []byte) int {
 
 	if nFree == 0 {
 		q.interrupt()
-		return 0
+		return 0, ErrRingFull
+	}
+	err = q.checkSlots(nFree)
+	if err != nil {
+		return 0, err
 	}
 
 	// copy descriptor from shm
@@ -105,15 +137,19 @@ func (q *Queue) WritePacket(pkt []byte) int {
 	}
 	desc.setLength(0)
 	offset := desc.getOffset()
+	err = q.checkDesc(desc, packetBufferSize)
+	if err != nil {
+		return 0, err
+	}
 
 	// write packet into memif buffer
-	n := copy(q.port.regions[desc.getRegion()].data[offset:offset+packetBufferSize], pkt[:])
+	n = copy(q.port.regions[desc.getRegion()].data[offset:offset+packetBufferSize], pkt[:])
 	desc.setLength(n)
 	for n < len(pkt) {
 		nFree--
 		if nFree == 0 {
 			q.interrupt()
-			return 0
+			return 0, ErrRingFull
 		}
 		desc.setFlags(descFlagNext)
 		q.putDescBuf(slot&mask, desc)
@@ -129,8 +165,12 @@ func (q *Queue) WritePacket(pkt []byte) int {
 		}
 		desc.setLength(0)
 		offset := desc.getOffset()
+		err = q.checkDesc(desc, packetBufferSize)
+		if err != nil {
+			return 0, err
+		}
 
-		tmp := copy(q.port.regions[desc.getRegion()].data[offset:offset+packetBufferSize], pkt[:])
+		tmp := copy(q.port.regions[desc.getRegion()].data[offset:offset+packetBufferSize], pkt[n:])
 		desc.setLength(tmp)
 		n += tmp
 	}
@@ -147,5 +187,5 @@ func (q *Queue) WritePacket(pkt []byte) int {
 
 	q.interrupt()
 
-	return n
+	return n, nil
 }
@@ -0,0 +1,121 @@
+package zmemif
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// PeerCred holds the credentials of the process on the other side of
+// a control channel, as reported by SO_PEERCRED
+type PeerCred struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+// PeerCredPolicy decides which peers may connect. If any of UIDs, GIDs
+// or PIDs is set, the peer must match at least one listed id. If Func is
+// set, it must allow the peer as well. A zero policy allows every peer.
+type PeerCredPolicy struct {
+	UIDs []uint32
+	GIDs []uint32
+	PIDs []int32
+	Func func(cred PeerCred) bool
+}
+
+// allows returns nil if the policy allows the peer
+func (policy *PeerCredPolicy) allows(cred PeerCred) error {
+	if len(policy.UIDs) > 0 || len(policy.GIDs) > 0 || len(policy.PIDs) > 0 {
+		if !policy.listed(cred) {
+			return fmt.Errorf("%w: pid %d uid %d gid %d not allowed", ErrPeerCredDenied, cred.Pid, cred.Uid, cred.Gid)
+		}
+	}
+	if policy.Func != nil && !policy.Func(cred) {
+		return fmt.Errorf("%w: pid %d uid %d gid %d refused", ErrPeerCredDenied, cred.Pid, cred.Uid, cred.Gid)
+	}
+	return nil
+}
+
+// listed returns true if any of the peers ids is listed in the policy
+func (policy *PeerCredPolicy) listed(cred PeerCred) bool {
+	for _, uid := range policy.UIDs {
+		if uid == cred.Uid {
+			return true
+		}
+	}
+	for _, gid := range policy.GIDs {
+		if gid == cred.Gid {
+			return true
+		}
+	}
+	for _, pid := range policy.PIDs {
+		if pid == cred.Pid {
+			return true
+		}
+	}
+	return false
+}
+
+// readPeerCred returns the credentials of the peer connected to fd
+func readPeerCred(fd int) (*PeerCred, error) {
+	ucred, err := syscall.GetsockoptUcred(fd, syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	if err != nil {
+		return nil, fmt.Errorf("SO_PEERCRED: %v", err)
+	}
+	return &PeerCred{
+		Pid: ucred.Pid,
+		Uid: ucred.Uid,
+		Gid: ucred.Gid,
+	}, nil
+}
+
+// checkPeerCred applies policy to the peer of the control channel
+// and reports the decision. Port is nil for listener policy.
+func (cc *controlChannel) checkPeerCred(policy *PeerCredPolicy, port *Port) error {
+	var err error
+
+	if cc.peerCred == nil {
+		err = fmt.Errorf("%w: credentials unknown", ErrPeerCredDenied)
+	} else {
+		err = policy.allows(*cc.peerCred)
+	}
+
+	ev := Event{
+		Type:     EventPeerAccepted,
+		Port:     port,
+		PeerCred: cc.peerCred,
+		Err:      err,
+	}
+	if err != nil {
+		ev.Type = EventPeerRejected
+		cc.socket.logger.Warn("peer rejected", cc.logArgs(cc.peerCredLogArgs("error", err)...)...)
+	} else {
+		cc.socket.logger.Info("peer accepted", cc.logArgs(cc.peerCredLogArgs()...)...)
+	}
+	cc.socket.emit(ev)
+
+	return err
+}
+
+// peerCredLogArgs returns the peer credential log fields followed by args
+func (cc *controlChannel) peerCredLogArgs(args ...interface{}) []interface{} {
+	if cc.peerCred == nil {
+		return args
+	}
+	return append([]interface{}{
+		"peer_pid", cc.peerCred.Pid,
+		"peer_uid", cc.peerCred.Uid,
+		"peer_gid", cc.peerCred.Gid,
+	}, args...)
+}
+
+// PeerCred returns the credentials of the peer process. The second
+// return value is false if the port is not connecting or connected, or
+// the credentials could not be read. It is safe to call from any goroutine.
+func (p *Port) PeerCred() (PeerCred, bool) {
+	cred := p.peerCred.Load()
+	if cred == nil {
+		return PeerCred{}, false
+	}
+	return *cred, true
+}
@@ -0,0 +1,132 @@
+package zmemif
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zartbot/zmemif/controlmsg"
+)
+
+// peerCredPolicies returns policies allowing and denying the test process
+// by each of the policy fields
+func peerCredPolicies() []struct {
+	name   string
+	policy PeerCredPolicy
+	allow  bool
+} {
+	uid, gid, pid := uint32(os.Getuid()), uint32(os.Getgid()), int32(os.Getpid())
+	self := func(cred PeerCred) bool { return cred == PeerCred{Pid: pid, Uid: uid, Gid: gid} }
+	return []struct {
+		name   string
+		policy PeerCredPolicy
+		allow  bool
+	}{
+		{"uid allowed", PeerCredPolicy{UIDs: []uint32{uid + 1, uid}}, true},
+		{"uid denied", PeerCredPolicy{UIDs: []uint32{uid + 1}}, false},
+		{"gid allowed", PeerCredPolicy{GIDs: []uint32{gid}}, true},
+		{"gid denied", PeerCredPolicy{GIDs: []uint32{gid + 1}}, false},
+		{"pid allowed", PeerCredPolicy{PIDs: []int32{pid}}, true},
+		{"pid denied", PeerCredPolicy{PIDs: []int32{pid + 1}}, false},
+		{"func allowed", PeerCredPolicy{Func: self}, true},
+		{"func denied", PeerCredPolicy{Func: func(cred PeerCred) bool { return !self(cred) }}, false},
+		{"listed, func denied", PeerCredPolicy{UIDs: []uint32{uid}, Func: func(PeerCred) bool { return false }}, false},
+	}
+}
+
+// expectPeerEvent waits for the peer credential event of the test process
+// and checks it against the policy decision
+func expectPeerEvent(t *testing.T, events chan Event, allow bool, port *Port) {
+	t.Helper()
+	var ev Event
+	select {
+	case ev = <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no peer event")
+	}
+	if ev.PeerCred == nil || ev.PeerCred.Pid != int32(os.Getpid()) || ev.Port != port {
+		t.Fatalf("event %+v", ev)
+	}
+	if allow {
+		if ev.Type != EventPeerAccepted || ev.Err != nil {
+			t.Fatalf("allowed peer: %s %v", ev.Type, ev.Err)
+		}
+	} else if ev.Type != EventPeerRejected || !errors.Is(ev.Err, ErrPeerCredDenied) {
+		t.Fatalf("denied peer: %s %v", ev.Type, ev.Err)
+	}
+}
+
+// expectDenied checks that msg disconnects a peer denied by a policy
+func expectDenied(t *testing.T, msg controlmsg.Message) {
+	t.Helper()
+	dc, ok := msg.(*controlmsg.Disconnect)
+	if !ok {
+		t.Fatalf("denied peer got %s", msg.Type())
+	}
+	if DisconnectCode(dc.Code) != DisconnectCodePeerCredDenied {
+		t.Fatalf("disconnect code %s", DisconnectCode(dc.Code))
+	}
+}
+
+// TestListenerPeerCredPolicy connects to a socket with a PeerCredPolicy,
+// the listener must send Hello only to allowed peers
+func TestListenerPeerCredPolicy(t *testing.T) {
+	for _, tc := range peerCredPolicies() {
+		t.Run(tc.name, func(t *testing.T) {
+			events := make(chan Event, 16)
+			policy := tc.policy
+			file, _ := listeningSocket(t, WithPeerCredPolicy(&policy),
+				WithEventFunc(func(ev Event) { events <- ev }))
+			_, msg := dialListener(t, file)
+			if tc.allow {
+				if msg.Type() != controlmsg.TypeHello {
+					t.Fatalf("allowed peer got %s", msg.Type())
+				}
+			} else {
+				expectDenied(t, msg)
+			}
+			expectPeerEvent(t, events, tc.allow, nil)
+		})
+	}
+}
+
+// TestPortPeerCredPolicy attaches to a server port with a PeerCredPolicy,
+// the port must acknowledge Init only from allowed peers
+func TestPortPeerCredPolicy(t *testing.T) {
+	for _, tc := range peerCredPolicies() {
+		t.Run(tc.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "memif.sock")
+			events := make(chan Event, 16)
+			srv, err := NewSocket("srv", file, WithEventFunc(func(ev Event) { events <- ev }))
+			if err != nil {
+				t.Fatal(err)
+			}
+			drainErrors(srv)
+			defer closeSocket(t, srv)
+			policy := tc.policy
+			p, err := NewPort(srv, &PortCfg{Id: 0, Name: "srv", IsServer: true, PeerCredPolicy: &policy,
+				ConnectedFunc: nopConnected}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv.StartPolling()
+
+			r := dialRaw(t, file)
+			r.send(&controlmsg.Init{Version: controlmsg.Version}, -1)
+			msg := r.recv()
+			if tc.allow {
+				if msg.Type() != controlmsg.TypeAck {
+					t.Fatalf("allowed peer got %s", msg.Type())
+				}
+				if cred, ok := p.PeerCred(); !ok || cred.Pid != int32(os.Getpid()) {
+					t.Fatalf("port peer credentials %+v %v", cred, ok)
+				}
+			} else {
+				expectDenied(t, msg)
+			}
+			expectPeerEvent(t, events, tc.allow, p)
+		})
+	}
+}
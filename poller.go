@@ -0,0 +1,319 @@
+package zmemif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// QueueHandler is called by Poller when the interrupt eventfd of a
+// watched queue fires
+type QueueHandler func(q *Queue)
+
+// pollEntry associates a polled fd with its handler
+type pollEntry struct {
+	event  syscall.EpollEvent
+	handle func(event *syscall.EpollEvent)
+}
+
+// Poller runs a single epoll event loop for any number of sockets and,
+// optionally, queue interrupts. Use WithPoller to share a Poller between
+// sockets, sockets created without it own a private Poller.
+type Poller struct {
+	epfd      int
+	wakeEvent syscall.EpollEvent
+	// mu guards entries and running state
+	mu           sync.Mutex
+	entries      map[int32]*pollEntry
+	generation   int32
+	stopPollChan chan struct{}
+	wg           sync.WaitGroup
+	// loopId identifies the goroutine running the event loop
+	loopId atomic.Uint64
+	// ErrChan receives errors of the event loop itself. Errors of
+	// control channels are reported on the ErrChan of their socket.
+	ErrChan chan error
+}
+
+// NewPoller returns a new Poller. Call Start to run the event loop.
+func NewPoller() (*Poller, error) {
+	return newPoller(make(chan error, 1))
+}
+
+// newPoller returns a new Poller reporting loop errors to errChan
+func newPoller(errChan chan error) (*Poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("EpollCreate1: %s", err)
+	}
+
+	efd, err := eventFd()
+	if err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+
+	poller := &Poller{
+		epfd:    epfd,
+		entries: make(map[int32]*pollEntry),
+		ErrChan: errChan,
+	}
+	poller.wakeEvent = syscall.EpollEvent{
+		Events: syscall.EPOLLIN | syscall.EPOLLERR | syscall.EPOLLHUP,
+		Fd:     int32(efd),
+	}
+	err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, efd, &poller.wakeEvent)
+	if err != nil {
+		syscall.Close(efd)
+		syscall.Close(epfd)
+		return nil, fmt.Errorf("EpollCtl: %s", err)
+	}
+
+	return poller, nil
+}
+
+// add starts polling fd, handle is called from the event loop
+func (poller *Poller) add(fd int, events uint32, handle func(event *syscall.EpollEvent)) error {
+	poller.mu.Lock()
+	defer poller.mu.Unlock()
+
+	if _, ok := poller.entries[int32(fd)]; ok {
+		return fmt.Errorf("fd %d is already polled", fd)
+	}
+
+	// fd numbers are reused, the generation stored in the event data
+	// identifies events reported for a previous owner of the fd
+	poller.generation++
+	entry := &pollEntry{
+		event: syscall.EpollEvent{
+			Events: events,
+			Fd:     int32(fd),
+			Pad:    poller.generation,
+		},
+		handle: handle,
+	}
+	err := syscall.EpollCtl(poller.epfd, syscall.EPOLL_CTL_ADD, fd, &entry.event)
+	if err != nil {
+		return fmt.Errorf("EpollCtl: %s", err)
+	}
+	poller.entries[int32(fd)] = entry
+
+	return nil
+}
+
+// del stops polling fd
+func (poller *Poller) del(fd int) error {
+	poller.mu.Lock()
+	defer poller.mu.Unlock()
+
+	entry, ok := poller.entries[int32(fd)]
+	if !ok {
+		return fmt.Errorf(errorFdNotFound)
+	}
+	delete(poller.entries, int32(fd))
+
+	err := syscall.EpollCtl(poller.epfd, syscall.EPOLL_CTL_DEL, fd, &entry.event)
+	if err != nil {
+		return fmt.Errorf("EpollCtl: %s", err)
+	}
+	return nil
+}
+
+// AddQueue adds the interrupt eventfd of q to the poller. handler is
+// called from the event loop each time the peer interrupts the queue.
+// The queue is removed automatically when its port disconnects, the
+// port is released once running handlers returned, like its workers.
+func (poller *Poller) AddQueue(q *Queue, handler QueueHandler) error {
+	socket := q.port.socket
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+
+	if q.poller != nil {
+		return fmt.Errorf("queue is already polled")
+	}
+
+	fd := q.interruptFd
+	err := poller.add(fd, syscall.EPOLLIN, func(event *syscall.EpollEvent) {
+		socket.mu.Lock()
+		if q.poller != poller {
+			// removed while the event was pending
+			socket.mu.Unlock()
+			return
+		}
+		q.port.handlers.Add(1)
+		socket.mu.Unlock()
+		defer q.port.handlers.Done()
+
+		// clear eventfd counter
+		var buf [8]byte
+		syscall.Read(fd, buf[:])
+		handler(q)
+	})
+	if err != nil {
+		return err
+	}
+	q.poller = poller
+
+	return nil
+}
+
+// DelQueue removes the interrupt eventfd of q from the poller
+func (poller *Poller) DelQueue(q *Queue) error {
+	q.port.socket.mu.Lock()
+	defer q.port.socket.mu.Unlock()
+
+	return poller.delQueue(q)
+}
+
+// delQueue removes the interrupt eventfd of q from the poller, socket
+// lock must be held
+func (poller *Poller) delQueue(q *Queue) error {
+	if q.poller != poller {
+		return fmt.Errorf("queue is not polled by this poller")
+	}
+	q.poller = nil
+
+	return poller.del(q.interruptFd)
+}
+
+// Start starts the event loop in a new goroutine
+func (poller *Poller) Start() {
+	poller.mu.Lock()
+	defer poller.mu.Unlock()
+
+	if poller.stopPollChan != nil {
+		// already running
+		return
+	}
+
+	stopPollChan := make(chan struct{})
+	poller.stopPollChan = stopPollChan
+	poller.wg.Add(1)
+	go poller.loop(stopPollChan)
+}
+
+// Stop stops the event loop and waits until it returns. Called from an
+// event handler, for example by Socket.Close in ConnectedFunc, it doesn't
+// wait, the loop returns once the handler returned.
+func (poller *Poller) Stop() error {
+	poller.mu.Lock()
+	stopPollChan := poller.stopPollChan
+	poller.stopPollChan = nil
+	poller.mu.Unlock()
+
+	if stopPollChan == nil {
+		return nil
+	}
+
+	// stop polling msg
+	close(stopPollChan)
+	// wake epoll
+	buf := make([]byte, 8)
+	binary.PutUvarint(buf, 1)
+	n, err := syscall.Write(int(poller.wakeEvent.Fd), buf[:])
+	if err != nil {
+		return err
+	}
+	if n != 8 {
+		return fmt.Errorf("faild to write to eventfd")
+	}
+	if goroutineId() == poller.loopId.Load() {
+		// the loop is waiting for the caller
+		return nil
+	}
+	// wait until polling is stopped
+	poller.wg.Wait()
+
+	return nil
+}
+
+// loop waits for events and dispatches them to their handlers
+func (poller *Poller) loop(stopPollChan chan struct{}) {
+	var events [maxEpollEvents]syscall.EpollEvent
+	defer poller.wg.Done()
+	poller.loopId.Store(goroutineId())
+	defer poller.loopId.Store(0)
+
+	for {
+		select {
+		case <-stopPollChan:
+			return
+		default:
+		}
+
+		num, err := syscall.EpollWait(poller.epfd, events[:], -1)
+		if err != nil {
+			if errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			poller.reportError(fmt.Errorf("epollWait: %v", err))
+			return
+		}
+
+		for ev := 0; ev < num; ev++ {
+			event := &events[ev]
+			if event.Fd == poller.wakeEvent.Fd {
+				// clear eventfd counter
+				var buf [8]byte
+				syscall.Read(int(event.Fd), buf[:])
+				continue
+			}
+
+			poller.mu.Lock()
+			entry, ok := poller.entries[event.Fd]
+			poller.mu.Unlock()
+			// the fd may have been removed or reused since epoll
+			// reported the event
+			if !ok || entry.event.Pad != event.Pad {
+				continue
+			}
+			entry.handle(event)
+		}
+	}
+}
+
+// goroutineId returns the id of the calling goroutine, parsed from the
+// "goroutine N [status]:" header of its stack trace
+func goroutineId() uint64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	fields := bytes.Fields(buf[:n])
+	if len(fields) < 2 {
+		return 0
+	}
+	id, _ := strconv.ParseUint(string(fields[1]), 10, 64)
+	return id
+}
+
+// reportError sends err to ErrChan without blocking the event loop
+func (poller *Poller) reportError(err error) {
+	select {
+	case poller.ErrChan <- err:
+	default:
+	}
+}
+
+// Close stops the event loop and releases the epoll instance. Sockets
+// and queues using the poller must be deleted first.
+func (poller *Poller) Close() error {
+	err := poller.Stop()
+	if err != nil {
+		return err
+	}
+
+	err = syscall.Close(int(poller.wakeEvent.Fd))
+	if err != nil {
+		return fmt.Errorf("failed to close eventfd: %v", err)
+	}
+	err = syscall.Close(poller.epfd)
+	if err != nil {
+		return fmt.Errorf("failed to close epoll: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package zmemif
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestQueueHandlerRelease disconnects a port while one of its queue
+// handlers runs, the port must not be released before the handler returns
+func TestQueueHandlerRelease(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "memif.sock")
+	queues, err := NewPoller()
+	if err != nil {
+		t.Fatal(err)
+	}
+	queues.Start()
+	srv, err := NewSocket("srv", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := NewSocket("cli", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(srv)
+	drainErrors(cli)
+
+	entered := make(chan struct{})
+	proceed := make(chan struct{})
+	result := make(chan error, 1)
+	sp, err := NewPort(srv, &PortCfg{Id: 0, Name: "srv", IsServer: true, ConnectedFunc: func(p *Port) error {
+		q, err := p.GetRxQueue(0)
+		if err != nil {
+			return err
+		}
+		return queues.AddQueue(q, func(q *Queue) {
+			close(entered)
+			<-proceed
+			buf := make([]byte, 2048)
+			n, err := q.ReadPacket(buf)
+			if err == nil && string(buf[:n]) != "ping" {
+				err = fmt.Errorf("got %q", buf[:n])
+			}
+			result <- err
+		})
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.StartPolling()
+	_, err = NewPort(cli, &PortCfg{Id: 0, Name: "cli", ConnectedFunc: func(p *Port) error {
+		p.Wg.Add(1)
+		go func() {
+			defer p.Wg.Done()
+			q, err := p.GetTxQueue(0)
+			if err == nil {
+				q.WritePacket([]byte("ping"))
+			}
+		}()
+		return nil
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.StartPolling()
+
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queue handler not called")
+	}
+	closeSocket(t, cli)
+	waitFor(t, "server disconnected", func() bool { return sp.DisconnectReason() != nil })
+	time.Sleep(50 * time.Millisecond)
+	srv.mu.Lock()
+	mapped := len(sp.regions) > 0
+	srv.mu.Unlock()
+	if !mapped {
+		t.Fatal("port released while its queue handler runs")
+	}
+
+	close(proceed)
+	err = <-result
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "port released", func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return len(sp.regions) == 0
+	})
+	closeSocket(t, srv)
+	err = queues.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -29,12 +29,18 @@
 // queue.WritePacket() on tx queues. If the interface is disconnected
 // queue.ReadPacket() and queue.WritePacket() MUST not be called.
 //
+// Sockets created with WithPoller() share a single event loop started by
+// poller.Start(), which can also deliver queue interrupts registered with
+// poller.AddQueue().
+//
 // Data transmission is backed by shared memory. The driver works in
 // promiscuous mode only.
 
 package zmemif
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"syscall"
 )
@@ -66,10 +72,22 @@ func (p *Port) GetMemoryConfig() MemoryConfig {
 	return p.run
 }
 
+// NumTxQueues returns the number of tx queues negotiated with the peer.
+// If Port is not connected the result is invalid.
+func (p *Port) NumTxQueues() int {
+	return int(p.run.NumTxQueues)
+}
+
+// NumRxQueues returns the number of rx queues negotiated with the peer.
+// If Port is not connected the result is invalid.
+func (p *Port) NumRxQueues() int {
+	return int(p.run.NumRxQueues)
+}
+
 // GetRxQueue returns an rx queue specified by queue index
 func (p *Port) GetRxQueue(qid int) (*Queue, error) {
 	if qid >= len(p.rxQueues) {
-		return nil, fmt.Errorf("invalid Queue index")
+		return nil, ErrInvalidQueue
 	}
 	return &p.rxQueues[qid], nil
 }
@@ -77,7 +95,7 @@ func (p *Port) GetRxQueue(qid int) (*Queue, error) {
 // GetRxQueue returns a tx queue specified by queue index
 func (p *Port) GetTxQueue(qid int) (*Queue, error) {
 	if qid >= len(p.txQueues) {
-		return nil, fmt.Errorf("invalid Queue index")
+		return nil, ErrInvalidQueue
 	}
 	return &p.txQueues[qid], nil
 }
@@ -105,36 +123,65 @@ func RoleToString(isServer bool) string {
 	return "Client"
 }
 
+// link states of a port
+const (
+	linkStateDown uint32 = iota
+	linkStateConnecting
+	linkStateUp
+)
+
+// setLinkState updates link state reported by IsConnecting and IsConnected
+func (p *Port) setLinkState(state uint32) {
+	p.linkState.Store(state)
+}
+
 // IsConnecting returns true if the port is connecting
+// or connected. It is safe to call from any goroutine.
 func (p *Port) IsConnecting() bool {
-	return p.cc != nil
+	return p.linkState.Load() != linkStateDown
 }
 
-// IsConnected returns true if the port is connected
+// IsConnected returns true if the port is connected.
+// It is safe to call from any goroutine.
 func (p *Port) IsConnected() bool {
-	if p.cc != nil && p.cc.isConnected {
-		return true
-	}
-	return false
+	return p.linkState.Load() == linkStateUp
 }
 
 // Disconnect disconnects the port
 func (p *Port) Disconnect() (err error) {
+	p.socket.mu.Lock()
+	defer p.socket.mu.Unlock()
+
+	return p.disconnectLocked()
+}
+
+// disconnectLocked disconnects the port, socket lock must be held
+func (p *Port) disconnectLocked() (err error) {
 	if p.cc != nil {
 		// close control and disconenct port
-		return p.cc.close(true, "Port disconnected")
+		return p.cc.close(true, ErrShutdown)
 	}
 	return nil
 }
 
 // Delete deletes the port
 func (p *Port) Delete() (err error) {
-	p.Disconnect()
+	p.socket.mu.Lock()
+	defer p.socket.mu.Unlock()
+
+	return p.delete()
+}
+
+// delete deletes the port, socket lock must be held
+func (p *Port) delete() (err error) {
+	err = p.disconnectLocked()
 	// remove referance on socket
-	p.socket.portList.Remove(p.listRef)
-	p = nil
+	key := portKey{id: p.cfg.Id, isServer: p.cfg.IsServer}
+	if p.socket.ports[key] == p {
+		delete(p.socket.ports, key)
+	}
 
-	return nil
+	return err
 }
 
 // RequestConnection is used by client port to connect to a socket and
@@ -143,8 +190,18 @@ func (p *Port) RequestConnection() error {
 	if p.IsServer() {
 		return fmt.Errorf("only client can request connection")
 	}
+
+	p.socket.mu.Lock()
+	defer p.socket.mu.Unlock()
+
+	if p.cc != nil {
+		return fmt.Errorf("port is already connecting")
+	}
+	if p.callback {
+		return fmt.Errorf("port is disconnecting")
+	}
 	// create socket
-	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
 	if err != nil {
 		return fmt.Errorf("failed to create UNIX domain socket: %v", err)
 	}
@@ -153,19 +210,47 @@ func (p *Port) RequestConnection() error {
 	// Connect to listener socket
 	err = syscall.Connect(fd, usa)
 	if err != nil {
+		syscall.Close(fd)
 		return fmt.Errorf("failed to connect socket %s : %v", p.socket.filename, err)
 	}
+	err = syscall.SetNonblock(fd, true)
+	if err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("failed to set non-blocking mode: %v", err)
+	}
 
 	// Create control channel
-	p.cc, err = p.socket.addControlChannel(fd, p)
+	cc, err := p.socket.addControlChannel(fd, p)
 	if err != nil {
+		syscall.Close(fd)
 		return fmt.Errorf("failed to create control channel: %v", err)
 	}
+	p.cc = cc
+	p.peerCred.Store(cc.peerCred)
+	p.setLinkState(linkStateConnecting)
+	cc.startHandshake()
 	return nil
 }
 
-// connect finalizes interface connection
-func (p *Port) connect() (err error) {
+// connect finalizes interface connection. Queues of a resumed port keep
+// the ring positions handed over by the other process.
+func (p *Port) connect(resumed bool) (err error) {
+	// the client may skip ring indexes
+	for i := range p.txQueues {
+		if p.txQueues[i].ring == nil {
+			return fmt.Errorf("%w: missing M2S ring %d", ErrProtocol, i)
+		}
+	}
+	for i := range p.rxQueues {
+		if p.rxQueues[i].ring == nil {
+			return fmt.Errorf("%w: missing S2M ring %d", ErrProtocol, i)
+		}
+	}
+
+	if p.guardFaults {
+		defer p.recoverFault(guardFault(), &err)
+	}
+
 	for rid := range p.regions {
 		r := &p.regions[rid]
 		if r.data == nil {
@@ -176,41 +261,172 @@ func (p *Port) connect() (err error) {
 		}
 	}
 
-	for _, q := range p.txQueues {
+	for i := range p.txQueues {
+		q := &p.txQueues[i]
 		q.updateRing()
 
 		if q.ring.getCookie() != cookie {
-			return fmt.Errorf("wrong cookie")
+			return ErrWrongCookie
 		}
 
-		q.lastHead = 0
-		q.lastTail = 0
+		if !resumed {
+			q.lastHead = 0
+			q.lastTail = 0
+		}
 	}
 
-	for _, q := range p.rxQueues {
+	for i := range p.rxQueues {
+		q := &p.rxQueues[i]
 		q.updateRing()
 
 		if q.ring.getCookie() != cookie {
-			return fmt.Errorf("wrong cookie")
+			return ErrWrongCookie
+		}
+
+		if !resumed {
+			q.lastHead = 0
+			q.lastTail = 0
 		}
+	}
 
-		q.lastHead = 0
-		q.lastTail = 0
+	// the server learns the queue counts from the rings added by the client
+	p.run.NumTxQueues = uint16(len(p.txQueues))
+	p.run.NumRxQueues = uint16(len(p.rxQueues))
+	p.run.NumQueuePairs = min16(p.run.NumTxQueues, p.run.NumRxQueues)
+	if len(p.txQueues) > 0 {
+		p.run.Log2RingSize = uint8(p.txQueues[0].ring.log2Size)
 	}
 
-	return p.cfg.ConnectedFunc(p)
+	p.session.Add(1)
+
+	n := p.newNegotiation()
+	p.negotiation.Store(n)
+	p.logNegotiation(n)
+
+	p.socket.logger.Info("port connected", p.logArgs("peer_name", p.peerName,
+		"num_tx_queues", p.run.NumTxQueues, "num_rx_queues", p.run.NumRxQueues)...)
+
+	p.startLiveness()
+
+	p.running = true
+	p.callback = true
+	p.socket.unlocked(func() {
+		err = p.cfg.ConnectedFunc(p)
+	})
+	p.callback = false
+
+	if p.pendingDc {
+		// the port was disconnected while ConnectedFunc ran
+		p.pendingDc = false
+		cbErr, waitErr := p.stopWorkers(context.Background())
+		dcErr := fmt.Errorf("disconnected while ConnectedFunc ran: %w", p.disconnectErr.Load())
+		return errors.Join(err, dcErr, cbErr, p.releaseStopped(waitErr))
+	}
+	return err
+}
+
+// DisconnectReason returns the reason of the last disconnect as
+// *DisconnectError, or nil if the port has not been disconnected yet.
+// It is safe to call from any goroutine.
+func (p *Port) DisconnectReason() error {
+	dcErr := p.disconnectErr.Load()
+	if dcErr == nil {
+		return nil
+	}
+	return dcErr
 }
 
-// disconnect finalizes port disconnection
-func (p *Port) disconnect() (err error) {
+// disconnect finalizes port disconnection. Once DisconnectedFunc returns,
+// it waits until the port workers tracked by Wg stop or ctx expires. In the
+// latter case shared memory is left mapped, as the workers may still use it.
+// If a callback of the port is running, the disconnect is finished once
+// it returns. Socket lock must be held, it is released while
+// DisconnectedFunc runs and workers stop.
+func (p *Port) disconnect(ctx context.Context, reason *DisconnectError) (err error) {
 	if p.cc == nil { // disconnected
 		return nil
 	}
-	err = p.cfg.DisconnectedFunc(p)
-	if err != nil {
-		return fmt.Errorf("disconnectedFunc: %v", err)
+	p.cc = nil
+	p.stopLiveness()
+	p.setLinkState(linkStateDown)
+	p.peerCred.Store(nil)
+	p.disconnectErr.Store(reason)
+	p.socket.logger.Info("port disconnected", p.logArgs("reason", reason)...)
+
+	if p.callback {
+		// the callback may run on this goroutine, waiting for it here
+		// could deadlock
+		p.pendingDc = true
+		return nil
+	}
+	if !p.running {
+		// the handshake failed, there are no workers to stop
+		return p.releaseStopped(nil)
 	}
 
+	cbErr, waitErr := p.stopWorkers(ctx)
+	return errors.Join(cbErr, p.releaseStopped(waitErr))
+}
+
+// stopWorkers calls DisconnectedFunc and waits until running queue
+// handlers and the port workers tracked by Wg stop or ctx expires. Both run with the socket unlocked, so
+// that workers may call Socket and Port methods while they stop. Socket
+// lock must be held.
+func (p *Port) stopWorkers(ctx context.Context) (cbErr error, waitErr error) {
+	p.running = false
+	p.stopQueues()
+	p.callback = true
+	p.socket.unlocked(func() {
+		cbErr = p.cfg.DisconnectedFunc(p)
+		waitErr = waitContext(ctx, &p.handlers)
+		if waitErr == nil {
+			waitErr = waitContext(ctx, &p.Wg)
+		}
+	})
+	p.callback = false
+
+	if cbErr != nil {
+		cbErr = fmt.Errorf("disconnectedFunc: %v", cbErr)
+	}
+	return cbErr, waitErr
+}
+
+// stopQueues removes the queues of the port from their pollers, no queue
+// handler starts afterwards, socket lock must be held
+func (p *Port) stopQueues() {
+	for _, queues := range [][]Queue{p.txQueues, p.rxQueues} {
+		for i := range queues {
+			if queues[i].poller != nil {
+				queues[i].poller.delQueue(&queues[i])
+			}
+		}
+	}
+}
+
+// releaseStopped releases a disconnected port once stopWorkers returned,
+// socket lock must be held
+func (p *Port) releaseStopped(waitErr error) error {
+	var deleteErr error
+	if p.autoDelete {
+		deleteErr = p.delete()
+	}
+
+	if waitErr != nil {
+		return errors.Join(deleteErr, fmt.Errorf("port workers did not stop: %w", waitErr))
+	}
+
+	err := p.release()
+
+	p.peerName = ""
+	p.remoteName = ""
+
+	return errors.Join(deleteErr, err)
+}
+
+// release closes queues and unmaps and closes memory regions
+func (p *Port) release() error {
+	var errs []error
+
 	for _, q := range p.txQueues {
 		q.close()
 	}
@@ -223,30 +439,28 @@ func (p *Port) disconnect() (err error) {
 
 	// unmap regions
 	for _, r := range p.regions {
-		err = syscall.Munmap(r.data)
-		if err != nil {
-			return err
+		if r.data != nil {
+			err := syscall.Munmap(r.data)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("munmap: %v", err))
+			}
 		}
-		err = syscall.Close(r.fd)
+		err := syscall.Close(r.fd)
 		if err != nil {
-			return err
+			errs = append(errs, fmt.Errorf("failed to close region: %v", err))
 		}
 	}
 	p.regions = nil
-	p.cc = nil
+	p.guardFaults = false
 
-	p.peerName = ""
-	p.remoteName = ""
-
-	return nil
+	return errors.Join(errs...)
 }
 
-// defaultDisconnectedFunc
+// defaultDisconnectedFunc stops port workers, the caller waits
+// until they are done
 func defaultDisconnectedFunc(p *Port) error {
-	fmt.Println("Disconnected: ", p.GetName())
 	close(p.QuitChan) // stop polling
 	close(p.ErrChan)
-	p.Wg.Wait() // wait until polling stops, then continue disconnect
 	return nil
 }
 
@@ -261,8 +475,8 @@ func (p *Port) String() string {
 		link, p.GetRemoteName(), p.GetPeerName())
 	if p.IsConnected() {
 		mc := p.GetMemoryConfig()
-		result += fmt.Sprintf("queue pairs: %d\nring size: %d\nbuffer size: %d\n",
-			mc.NumQueuePairs, (1 << mc.Log2RingSize), mc.PacketBufferSize)
+		result += fmt.Sprintf("tx queues: %d\nrx queues: %d\nring size: %d\nbuffer size: %d\n",
+			mc.NumTxQueues, mc.NumRxQueues, (1 << mc.Log2RingSize), mc.PacketBufferSize)
 	}
 	return result
 }
@@ -14,6 +14,7 @@ type Queue struct {
 	lastHead    uint16
 	lastTail    uint16
 	interruptFd int
+	poller      *Poller
 }
 
 // GetEventFd returns queues interrupt event fd
@@ -23,7 +24,12 @@ func (q *Queue) GetEventFd() (int, error) {
 
 // close closes the queue
 func (q *Queue) close() {
-	syscall.Close(q.interruptFd)
+	if q.poller != nil {
+		q.poller.delQueue(q)
+	}
+	if q.interruptFd >= 0 {
+		syscall.Close(q.interruptFd)
+	}
 }
 
 // readHead reads ring head directly form the shared memory
@@ -0,0 +1,225 @@
+package zmemif
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestClientMoreQueuesThanServer connects a client configured with more
+// queues than the server, the server adopts the rings added by the client
+func TestClientMoreQueuesThanServer(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "memif.sock")
+	srv, err := NewSocket("srv", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := NewSocket("cli", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(srv)
+	drainErrors(cli)
+
+	// the server side runs in a port worker once the client wrote its
+	// packets
+	start := make(chan struct{})
+	result := make(chan error, 1)
+	_, err = NewPort(srv, &PortCfg{Id: 0, Name: "srv", IsServer: true, ConnectedFunc: func(p *Port) error {
+		p.Wg.Add(1)
+		go func() {
+			defer p.Wg.Done()
+			<-start
+			result <- echoQueues(p)
+		}()
+		return nil
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.StartPolling()
+	cli.StartPolling()
+	cp, err := NewPort(cli, &PortCfg{Id: 0, Name: "cli", ConnectedFunc: nopConnected,
+		MemoryConfig: MemoryConfig{NumTxQueues: 2, NumRxQueues: 4}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "client connected", cp.IsConnected)
+
+	buf := make([]byte, 2048)
+	for q := 0; q < cp.NumTxQueues(); q++ {
+		tq, err := cp.GetTxQueue(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tq.WritePacket([]byte(fmt.Sprint("c2s ", q)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for q := 0; q < cp.NumRxQueues(); q++ {
+		// the client refills its rx ring on read
+		rq, err := cp.GetRxQueue(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rq.ReadPacket(buf)
+	}
+	close(start)
+	select {
+	case err = <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+	for q := 0; q < cp.NumRxQueues(); q++ {
+		rq, err := cp.GetRxQueue(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, _ := rq.ReadPacket(buf)
+		if string(buf[:n]) != fmt.Sprint("s2c ", q) {
+			t.Fatalf("queue %d: got %q", q, buf[:n])
+		}
+	}
+
+	closeSocket(t, cli)
+	closeSocket(t, srv)
+}
+
+// echoQueues reads a packet from every rx queue of the server port and
+// writes one to every tx queue
+func echoQueues(p *Port) error {
+	if p.NumRxQueues() != 2 || p.NumTxQueues() != 4 {
+		return fmt.Errorf("server queues rx %d tx %d, want rx 2 tx 4", p.NumRxQueues(), p.NumTxQueues())
+	}
+	buf := make([]byte, 2048)
+	for q := 0; q < p.NumRxQueues(); q++ {
+		rq, err := p.GetRxQueue(q)
+		if err != nil {
+			return err
+		}
+		n, _ := rq.ReadPacket(buf)
+		if string(buf[:n]) != fmt.Sprint("c2s ", q) {
+			return fmt.Errorf("queue %d: got %q", q, buf[:n])
+		}
+	}
+	for q := 0; q < p.NumTxQueues(); q++ {
+		tq, err := p.GetTxQueue(q)
+		if err != nil {
+			return err
+		}
+		_, err = tq.WritePacket([]byte(fmt.Sprint("s2c ", q)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TestChainedPackets sends packets larger than a packet buffer in both
+// directions, they are chained over several descriptors
+func TestChainedPackets(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "memif.sock")
+	srv, err := NewSocket("srv", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := NewSocket("cli", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(srv)
+	drainErrors(cli)
+
+	pkt := make([]byte, 1000)
+	for i := range pkt {
+		pkt[i] = byte(i % 251)
+	}
+
+	// the server echoes the packet from a port worker
+	start := make(chan struct{})
+	result := make(chan error, 1)
+	_, err = NewPort(srv, &PortCfg{Id: 0, Name: "srv", IsServer: true, ConnectedFunc: func(p *Port) error {
+		p.Wg.Add(1)
+		go func() {
+			defer p.Wg.Done()
+			<-start
+			result <- echoPacket(p, pkt)
+		}()
+		return nil
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.StartPolling()
+	cli.StartPolling()
+	cp, err := NewPort(cli, &PortCfg{Id: 0, Name: "cli", ConnectedFunc: nopConnected,
+		MemoryConfig: MemoryConfig{PacketBufferSize: 256}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "client connected", cp.IsConnected)
+
+	tq, err := cp.GetTxQueue(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := tq.WritePacket(pkt)
+	if err != nil || n != len(pkt) {
+		t.Fatalf("wrote %d bytes: %v", n, err)
+	}
+	rq, err := cp.GetRxQueue(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	// the client refills its rx ring on read
+	rq.ReadPacket(buf)
+	close(start)
+	select {
+	case err = <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+	n, err = rq.ReadPacket(buf)
+	if err != nil || !bytes.Equal(buf[:n], pkt) {
+		t.Fatalf("client read %d bytes: %v", n, err)
+	}
+
+	closeSocket(t, cli)
+	closeSocket(t, srv)
+}
+
+// echoPacket reads pkt from rx queue 0 of the server port and writes it
+// back to tx queue 0
+func echoPacket(p *Port, pkt []byte) error {
+	rq, err := p.GetRxQueue(0)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 2048)
+	n, err := rq.ReadPacket(buf)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(buf[:n], pkt) {
+		return fmt.Errorf("server read %d bytes, not the packet written", n)
+	}
+	tq, err := p.GetTxQueue(0)
+	if err != nil {
+		return err
+	}
+	n, err = tq.WritePacket(buf[:n])
+	if err != nil || n != len(pkt) {
+		return fmt.Errorf("server wrote %d bytes: %v", n, err)
+	}
+	return nil
+}
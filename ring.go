@@ -36,6 +36,7 @@ func newRing(regionIndex int, ringType ringType, ringOffset int, log2RingSize in
 		ringType: ringType,
 		size:     (1 << log2RingSize),
 		log2Size: log2RingSize,
+		region:   regionIndex,
 		rb:       make(ringBuf, ringSize),
 		offset:   ringOffset,
 	}
@@ -49,6 +50,7 @@ func (p *Port) newRing(regionIndex int, ringType ringType, ringIndex int) *ring
 		ringType: ringType,
 		size:     (1 << p.run.Log2RingSize),
 		log2Size: int(p.run.Log2RingSize),
+		region:   regionIndex,
 		rb:       make(ringBuf, ringSize),
 	}
 
@@ -56,7 +58,7 @@ func (p *Port) newRing(regionIndex int, ringType ringType, ringIndex int) *ring
 	if r.ringType == ringTypeS2M {
 		r.offset = 0
 	} else {
-		r.offset = int(p.run.NumQueuePairs) * rSize
+		r.offset = int(p.run.NumTxQueues) * rSize
 	}
 	r.offset += ringIndex * rSize
 
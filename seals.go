@@ -0,0 +1,110 @@
+package zmemif
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"syscall"
+)
+
+// regionSeals returns the seals of a region fd received from the peer
+// after verifying that the file can back a region of size bytes. memfd
+// is false for regular files that don't support sealing, which are files
+// other than memfds, for example hugetlbfs files.
+func regionSeals(fd int, size uint64) (seals int, memfd bool, err error) {
+	var st syscall.Stat_t
+
+	err = syscall.Fstat(fd, &st)
+	if err != nil {
+		return 0, false, fmt.Errorf("fstat: %w", err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return 0, false, fmt.Errorf("%w: memory region fd is not a regular file", ErrProtocol)
+	}
+	if uint64(st.Size) < size {
+		return 0, false, fmt.Errorf("%w: memory region file of %d bytes is smaller than region size %d", ErrProtocol, st.Size, size)
+	}
+
+	r, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), uintptr(f_get_seals), 0)
+	if errno == syscall.EINVAL {
+		return 0, false, nil
+	}
+	if errno != 0 {
+		return 0, false, os.NewSyscallError("fcntl", errno)
+	}
+	return int(r), true, nil
+}
+
+// checkRegionFd verifies a region fd received from the peer. A region
+// that is not a memfd sealed against shrinking is refused if the
+// negotiation policy requires seals. Otherwise it is accepted, so that
+// peers backing regions with hugetlbfs files keep working, and the
+// datapath of the port is guarded against faults caused by the peer
+// truncating the file.
+func (p *Port) checkRegionFd(fd int, size uint64) error {
+	seals, memfd, err := regionSeals(fd, size)
+	if err != nil {
+		return err
+	}
+	if seals&f_seal_shrink == f_seal_shrink {
+		return nil
+	}
+
+	np := p.negotiationPolicy()
+	requireSeals := np != nil && np.RequireSeals
+	if !memfd {
+		if requireSeals {
+			return fmt.Errorf("%w: memory region fd is not a memfd", ErrUnsealedRegion)
+		}
+		p.socket.logger.Warn("accepting memory region that is not a memfd", p.logArgs()...)
+	} else {
+		if requireSeals {
+			return fmt.Errorf("%w: seals %#x", ErrUnsealedRegion, seals)
+		}
+		p.socket.logger.Warn("accepting memory region not sealed against shrinking", p.logArgs("seals", seals)...)
+	}
+	p.guardFaults = true
+	return nil
+}
+
+// faultAddr is implemented by runtime errors caused by a memory fault
+type faultAddr interface {
+	Addr() uintptr
+}
+
+// guardFault makes memory faults of the calling goroutine recoverable,
+// the returned value is passed to recoverFault
+func guardFault() bool {
+	return debug.SetPanicOnFault(true)
+}
+
+// faultError returns the error reported for the value recovered after a
+// memory fault, other panics are passed on
+func faultError(r interface{}) error {
+	fault, ok := r.(faultAddr)
+	if !ok {
+		panic(r)
+	}
+	return fmt.Errorf("%w: fault at address %#x", ErrMemoryFault, fault.Addr())
+}
+
+// recoverFault must be deferred after guardFault. It turns a fault on
+// shared memory, caused by the peer shrinking an unsealed region, into
+// err.
+func (p *Port) recoverFault(old bool, err *error) {
+	debug.SetPanicOnFault(old)
+	if r := recover(); r != nil {
+		*err = faultError(r)
+	}
+}
+
+// recoverFault recovers faults in ReadPacket and WritePacket like
+// Port.recoverFault and disconnects the port
+func (q *Queue) recoverFault(old bool, n *int, err *error) {
+	debug.SetPanicOnFault(old)
+	if r := recover(); r != nil {
+		*n = 0
+		*err = faultError(r)
+		q.port.disconnectInvalid(*err)
+	}
+}
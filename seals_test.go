@@ -0,0 +1,100 @@
+package zmemif
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/zartbot/zmemif/controlmsg"
+)
+
+// regionFile returns a region fd of size bytes: a memfd sealed against
+// shrinking, an unsealed memfd or a plain file
+func regionFile(t *testing.T, kind string, size int) int {
+	t.Helper()
+	var fd int
+	var err error
+	switch kind {
+	case "file":
+		f, ferr := os.Create(filepath.Join(t.TempDir(), "region"))
+		if ferr != nil {
+			t.Fatal(ferr)
+		}
+		fd, err = syscall.Dup(int(f.Fd()))
+		f.Close()
+	case "sealed":
+		fd, err = memfdCreate("region", mfd_allow_sealing)
+	default:
+		fd, err = memfdCreate("region", 0)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+	err = syscall.Ftruncate(fd, int64(size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind == "sealed" {
+		_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), uintptr(f_add_seals), uintptr(f_seal_shrink))
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+	}
+	return fd
+}
+
+// TestRegionSeals adds memfds and plain files as regions to server ports
+// with and without NegotiationPolicy.RequireSeals
+func TestRegionSeals(t *testing.T) {
+	for _, tc := range []struct {
+		kind         string
+		requireSeals bool
+		reason       string // disconnect reason, empty if accepted
+		guarded      bool
+	}{
+		{"sealed", true, "", false},
+		{"sealed", false, "", false},
+		{"unsealed", true, "seals", false},
+		{"unsealed", false, "", true},
+		{"file", true, "not a memfd", false},
+		{"file", false, "", true},
+	} {
+		name := tc.kind
+		if tc.requireSeals {
+			name += " required"
+		}
+		t.Run(name, func(t *testing.T) {
+			np := &NegotiationPolicy{RequireSeals: tc.requireSeals}
+			file, srv := listeningSocket(t, WithNegotiationPolicy(np))
+			r := dialRaw(t, file)
+			r.send(&controlmsg.Init{Version: controlmsg.Version}, -1)
+			r.expect(controlmsg.TypeAck)
+			r.send(&controlmsg.AddRegion{Size: 4096}, regionFile(t, tc.kind, 4096))
+			msg := r.recv()
+
+			if tc.reason != "" {
+				dc, ok := msg.(*controlmsg.Disconnect)
+				if !ok {
+					t.Fatalf("got %s, want Disconnect", msg.Type())
+				}
+				reason := controlmsg.String(dc.String[:])
+				if DisconnectCode(dc.Code) != DisconnectCodeUnsealedRegion || !strings.Contains(reason, tc.reason) {
+					t.Fatalf("disconnect %s %q", DisconnectCode(dc.Code), reason)
+				}
+				return
+			}
+			if msg.Type() != controlmsg.TypeAck {
+				t.Fatalf("got %s, want Ack", msg.Type())
+			}
+			srv.mu.Lock()
+			guarded := srv.ports[portKey{0, true}].guardFaults
+			srv.mu.Unlock()
+			if guarded != tc.guarded {
+				t.Fatalf("guardFaults %v, want %v", guarded, tc.guarded)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package zmemif
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+)
+
+// SecretProvider returns the secrets accepted by server port p when a
+// client connects. Returning more than one secret allows rotating secrets
+// without disconnecting peers using the previous one. The client is
+// rejected if no secret or an error is returned, except for
+// ErrNoSecretRequired, which accepts clients without checking their
+// secret.
+type SecretProvider func(p *Port) ([][24]byte, error)
+
+// ErrNoSecretRequired is returned by a SecretProvider to accept clients
+// without a secret
+var ErrNoSecretRequired = errors.New("no secret required")
+
+// SecretFromString returns s as memif secret, s must not be longer
+// than 24 bytes
+func SecretFromString(s string) (secret [24]byte, err error) {
+	if len(s) > len(secret) {
+		return secret, fmt.Errorf("secret longer than %d bytes", len(secret))
+	}
+	copy(secret[:], s)
+	return secret, nil
+}
+
+// secrets returns the secrets accepted by the server port, a port
+// without SecretProvider and Secret requires none
+func (p *Port) secrets() ([][24]byte, error) {
+	if p.cfg.SecretProvider != nil {
+		return p.cfg.SecretProvider(p)
+	}
+	if p.socket.secretProvider != nil {
+		return p.socket.secretProvider(p)
+	}
+	if p.cfg.Secret == ([24]byte{}) {
+		return nil, ErrNoSecretRequired
+	}
+	return [][24]byte{p.cfg.Secret}, nil
+}
+
+// verifySecret checks the secret presented by the client (server only).
+// It fails closed: the client is rejected if the provider fails or
+// returns no secret.
+func (p *Port) verifySecret(secret [24]byte) error {
+	secrets, err := p.secrets()
+	if errors.Is(err, ErrNoSecretRequired) {
+		return nil
+	}
+	if err != nil {
+		// the peer is not told why
+		p.socket.logger.Warn("secret provider failed", p.logArgs("error", err)...)
+		return fmt.Errorf("%w: no secret available", ErrInvalidSecret)
+	}
+	if len(secrets) == 0 {
+		return fmt.Errorf("%w: no secret available", ErrInvalidSecret)
+	}
+	if secret == ([24]byte{}) {
+		return fmt.Errorf("%w: secret required", ErrInvalidSecret)
+	}
+
+	match := 0
+	for i := range secrets {
+		match |= subtle.ConstantTimeCompare(secrets[i][:], secret[:])
+	}
+	if match != 1 {
+		return ErrInvalidSecret
+	}
+	return nil
+}
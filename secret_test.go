@@ -0,0 +1,149 @@
+package zmemif
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zartbot/zmemif/controlmsg"
+)
+
+// connectPair connects a client port configured by cliCfg to a server
+// port configured by srvCfg. It returns once the client is connected or
+// was disconnected.
+func connectPair(t *testing.T, srvCfg, cliCfg PortCfg, opts ...SocketOption) (sp *Port, cp *Port) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "memif.sock")
+	srv, err := NewSocket("srv", file, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := NewSocket("cli", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(srv)
+	drainErrors(cli)
+	t.Cleanup(func() {
+		closeSocket(t, cli)
+		closeSocket(t, srv)
+	})
+
+	srvCfg.IsServer = true
+	srvCfg.ConnectedFunc = nopConnected
+	cliCfg.ConnectedFunc = nopConnected
+	sp, err = NewPort(srv, &srvCfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.StartPolling()
+	cp, err = NewPort(cli, &cliCfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.StartPolling()
+	waitFor(t, "client connected or disconnected", func() bool {
+		return cp.IsConnected() || cp.DisconnectReason() != nil
+	})
+	return sp, cp
+}
+
+// checkSecretRejected verifies that the client was disconnected by the
+// server for an invalid secret
+func checkSecretRejected(t *testing.T, sp, cp *Port, reason string) {
+	t.Helper()
+	if cp.IsConnected() || sp.IsConnected() {
+		t.Fatal("ports connected")
+	}
+	var dcErr *DisconnectError
+	if !errors.As(cp.DisconnectReason(), &dcErr) {
+		t.Fatalf("disconnect reason %v", cp.DisconnectReason())
+	}
+	if dcErr.Code != DisconnectCodeInvalidSecret || !dcErr.Remote || !errors.Is(dcErr, ErrInvalidSecret) {
+		t.Fatalf("disconnect reason %+v", dcErr)
+	}
+	if !strings.Contains(dcErr.Reason, reason) {
+		t.Fatalf("disconnect reason %q does not contain %q", dcErr.Reason, reason)
+	}
+}
+
+func TestSecret(t *testing.T) {
+	alpha, err := SecretFromString("alpha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	beta, err := SecretFromString("beta")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("matching", func(t *testing.T) {
+		sp, cp := connectPair(t, PortCfg{Id: 1, Secret: alpha}, PortCfg{Id: 1, Secret: alpha})
+		if !cp.IsConnected() {
+			t.Fatalf("client not connected: %v", cp.DisconnectReason())
+		}
+		waitFor(t, "server connected", sp.IsConnected)
+	})
+	t.Run("mismatched", func(t *testing.T) {
+		sp, cp := connectPair(t, PortCfg{Id: 1, Secret: alpha}, PortCfg{Id: 1, Secret: beta})
+		checkSecretRejected(t, sp, cp, ErrInvalidSecret.Error())
+	})
+	t.Run("missing", func(t *testing.T) {
+		sp, cp := connectPair(t, PortCfg{Id: 1, Secret: alpha}, PortCfg{Id: 1})
+		checkSecretRejected(t, sp, cp, "secret required")
+	})
+	t.Run("not required", func(t *testing.T) {
+		_, cp := connectPair(t, PortCfg{Id: 1}, PortCfg{Id: 1, Secret: beta})
+		if !cp.IsConnected() {
+			t.Fatalf("client not connected: %v", cp.DisconnectReason())
+		}
+	})
+	t.Run("too long", func(t *testing.T) {
+		_, err := SecretFromString(strings.Repeat("x", 25))
+		if err == nil {
+			t.Fatal("25 byte secret accepted")
+		}
+	})
+
+	// rotation: the socket accepts the old and the new secret
+	rotating := WithSecretProvider(func(p *Port) ([][24]byte, error) { return [][24]byte{alpha, beta}, nil })
+	for _, secret := range [][24]byte{alpha, beta} {
+		t.Run("provider "+controlmsg.String(secret[:]), func(t *testing.T) {
+			_, cp := connectPair(t, PortCfg{Id: 1}, PortCfg{Id: 1, Secret: secret}, rotating)
+			if !cp.IsConnected() {
+				t.Fatalf("client not connected: %v", cp.DisconnectReason())
+			}
+		})
+	}
+	t.Run("port provider", func(t *testing.T) {
+		// the port provider overrides the sockets
+		srvCfg := PortCfg{Id: 1, SecretProvider: func(p *Port) ([][24]byte, error) { return [][24]byte{beta}, nil }}
+		sp, cp := connectPair(t, srvCfg, PortCfg{Id: 1, Secret: alpha}, rotating)
+		checkSecretRejected(t, sp, cp, ErrInvalidSecret.Error())
+	})
+
+	// a failing or empty provider rejects every client
+	for _, tc := range []struct {
+		name     string
+		provider SecretProvider
+	}{
+		{"provider empty", func(p *Port) ([][24]byte, error) { return nil, nil }},
+		{"provider error", func(p *Port) ([][24]byte, error) { return nil, errors.New("vault unavailable") }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sp, cp := connectPair(t, PortCfg{Id: 1}, PortCfg{Id: 1, Secret: alpha}, WithSecretProvider(tc.provider))
+			checkSecretRejected(t, sp, cp, "no secret available")
+			if strings.Contains(cp.DisconnectReason().Error(), "vault") {
+				t.Fatalf("provider error sent to the peer: %v", cp.DisconnectReason())
+			}
+		})
+	}
+	t.Run("provider no secret required", func(t *testing.T) {
+		optOut := WithSecretProvider(func(p *Port) ([][24]byte, error) { return nil, ErrNoSecretRequired })
+		_, cp := connectPair(t, PortCfg{Id: 1}, PortCfg{Id: 1}, optOut)
+		if !cp.IsConnected() {
+			t.Fatalf("client not connected: %v", cp.DisconnectReason())
+		}
+	})
+}
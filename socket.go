@@ -1,47 +1,100 @@
 package zmemif
 
 import (
-	"container/list"
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"sync"
 	"syscall"
-
-	"github.com/sirupsen/logrus"
 )
 
+// portKey identifies a port on a socket
+type portKey struct {
+	id       uint32
+	isServer bool
+}
+
 // Socket represents a UNIX domain socket used for communication
-// between memif peers
+// between memif peers. It is safe to add and remove ports while the
+// socket is polling.
 type Socket struct {
-	appName      string
-	filename     string
-	listener     *listener
-	portList     *list.List
-	ccList       *list.List
-	epfd         int
-	wakeEvent    syscall.EpollEvent
-	stopPollChan chan struct{}
-	wg           sync.WaitGroup
-	ErrChan      chan error
-}
-
-// handleEvent handles epoll event
-func (socket *Socket) handleEvent(event *syscall.EpollEvent) error {
-	if socket.listener != nil && socket.listener.event.Fd == event.Fd {
-		return socket.listener.handleEvent(event)
-	}
-
-	for elt := socket.ccList.Front(); elt != nil; elt = elt.Next() {
-		cc, ok := elt.Value.(*controlChannel)
-		if ok {
-			if cc.event.Fd == event.Fd {
-				return cc.handleEvent(event)
-			}
-		}
+	appName  string
+	filename string
+	// mu guards listener, ports and control channels and serializes
+	// control channel handling with port management
+	mu       sync.Mutex
+	listener *listener
+	ports    map[portKey]*Port
+	ccs      map[int32]*controlChannel
+	closed   bool
+	fileCfg  socketFileCfg
+	// ownsFile is true if the socket file was created by the listener
+	ownsFile bool
+	// handover holds server ports handed over by another process
+	// until they are created by NewPort
+	handover  map[uint32]*handoverPort
+	poller    *Poller
+	ownPoller bool
+	logger    Logger
+	// secretProvider is used by server ports without SecretProvider
+	secretProvider SecretProvider
+	// peerCredPolicy is applied to every accepted connection
+	peerCredPolicy *PeerCredPolicy
+	// negotiationPolicy is advertised in hello and applied to server
+	// ports without NegotiationPolicy
+	negotiationPolicy *NegotiationPolicy
+	eventFunc         EventFunc
+	traceFunc         TraceFunc
+	portFactory       PortFactory
+	handshakeTimeouts HandshakeTimeouts
+	listenerLimits    ListenerLimits
+	listenerStats     listenerStats
+	acceptLimiter     acceptLimiter
+	ErrChan           chan error
+}
+
+// eventHandler handles epoll events of a listener or a control channel
+type eventHandler interface {
+	handleEvent(event *syscall.EpollEvent) error
+	isClosed() bool
+}
+
+// dispatch handles epoll event on behalf of the poller
+func (socket *Socket) dispatch(h eventHandler, event *syscall.EpollEvent) {
+	var err error
+
+	socket.mu.Lock()
+	// h may have been closed while the event was pending
+	if !socket.closed && !h.isClosed() {
+		err = h.handleEvent(event)
 	}
+	socket.mu.Unlock()
 
-	return fmt.Errorf(errorFdNotFound)
+	if err != nil {
+		socket.reportError(fmt.Errorf("handleEvent: %w", err))
+	}
+}
+
+// unlocked runs fn with the socket lock released, socket lock must be
+// held. User callbacks and waits for port workers run unlocked, so that
+// they may call Socket and Port methods. Callers must not rely on state
+// read before unlocked returns, ports mark themselves with Port.callback
+// meanwhile.
+func (socket *Socket) unlocked(fn func()) {
+	socket.mu.Unlock()
+	defer socket.mu.Lock()
+	fn()
+}
+
+// reportError sends err to ErrChan. The error is logged and dropped if
+// ErrChan is full, so that a slow reader can not stall a shared poller.
+func (socket *Socket) reportError(err error) {
+	select {
+	case socket.ErrChan <- err:
+	default:
+		socket.logger.Error("error dropped, ErrChan is full", socket.logArgs("error", err)...)
+	}
 }
 
 // GetFilename returns sockets filename
@@ -49,88 +102,74 @@ func (socket *Socket) GetFilename() string {
 	return socket.filename
 }
 
-// StopPolling stops polling events on the socket
+// GetPoller returns the poller handling events of the socket
+func (socket *Socket) GetPoller() *Poller {
+	return socket.poller
+}
+
+// StopPolling stops polling events on the socket. It has no effect if
+// the socket uses a shared poller, see WithPoller.
 func (socket *Socket) StopPolling() error {
-	if socket.stopPollChan != nil {
-		// stop polling msg
-		close(socket.stopPollChan)
-		// wake epoll
-		buf := make([]byte, 8)
-		binary.PutUvarint(buf, 1)
-		n, err := syscall.Write(int(socket.wakeEvent.Fd), buf[:])
-		if err != nil {
-			return err
-		}
-		if n != 8 {
-			return fmt.Errorf("faild to write to eventfd")
-		}
-		// wait until polling is stopped
-		socket.wg.Wait()
+	if !socket.ownPoller {
+		return nil
 	}
-
-	return nil
+	return socket.poller.Stop()
 }
 
 // StartPolling starts polling and handling events on the socket,
-// enabling communication between memif peers
+// enabling communication between memif peers. It has no effect if
+// the socket uses a shared poller, see WithPoller.
 func (socket *Socket) StartPolling() {
-	socket.stopPollChan = make(chan struct{})
-	socket.wg.Add(1)
-	go func() {
-		var events [maxEpollEvents]syscall.EpollEvent
-		defer socket.wg.Done()
-
-		for {
-			select {
-			case <-socket.stopPollChan:
-				return
-			default:
-				num, err := syscall.EpollWait(socket.epfd, events[:], -1)
-				if err != nil {
-					socket.ErrChan <- fmt.Errorf("epollWait: %v", err)
-					return
-				}
-
-				for ev := 0; ev < num; ev++ {
-					if events[0].Fd == socket.wakeEvent.Fd {
-						continue
-					}
-					err = socket.handleEvent(&events[0])
-					if err != nil {
-						socket.ErrChan <- fmt.Errorf("handleEvent: %v", err)
-					}
-				}
-			}
-		}
-	}()
+	if !socket.ownPoller {
+		return
+	}
+	socket.poller.Start()
 }
 
 // NewPort returns a new memif network port. When creating an port
 // it's id must be unique across socket with the exception of loopback interface
 // in which case the id is the same but role differs
 func (socket *Socket) NewPort(cfg *PortCfg) (*Port, error) {
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+
+	if socket.closed {
+		return nil, ErrSocketClosed
+	}
+
+	return socket.newPort(cfg)
+}
+
+// newPort creates and registers a new port, socket lock must be held
+func (socket *Socket) newPort(cfg *PortCfg) (*Port, error) {
 	var err error
+
 	// make sure the ID is unique on this socket
-	for elt := socket.portList.Front(); elt != nil; elt = elt.Next() {
-		p, ok := elt.Value.(*Port)
-		if ok {
-			if p.cfg.Id == cfg.Id && p.cfg.IsServer == cfg.IsServer {
-				return nil, fmt.Errorf("port with id %d role %s already exists on this socket", cfg.Id, RoleToString(cfg.IsServer))
-			}
-		}
+	key := portKey{id: cfg.Id, isServer: cfg.IsServer}
+	if _, ok := socket.ports[key]; ok {
+		return nil, fmt.Errorf("port with id %d role %s already exists on this socket", cfg.Id, RoleToString(cfg.IsServer))
 	}
 
 	// copy interface configuration
 	p := Port{
-		cfg: *cfg,
+		cfg:    *cfg,
+		socket: socket,
 	}
 	// set default values
 	if p.cfg.MemoryConfig.NumQueuePairs == 0 {
 		p.cfg.MemoryConfig.NumQueuePairs = DefaultNumQueuePairs
 	}
 
-	if p.cfg.MemoryConfig.NumQueuePairs > 8 {
-		logrus.Warn("queue pairs number > 8 may cause race condition, please use multiple interface instead")
+	if p.cfg.MemoryConfig.NumTxQueues == 0 {
+		p.cfg.MemoryConfig.NumTxQueues = p.cfg.MemoryConfig.NumQueuePairs
+	}
+	if p.cfg.MemoryConfig.NumRxQueues == 0 {
+		p.cfg.MemoryConfig.NumRxQueues = p.cfg.MemoryConfig.NumQueuePairs
+	}
+
+	if p.cfg.MemoryConfig.NumTxQueues > 8 || p.cfg.MemoryConfig.NumRxQueues > 8 {
+		socket.logger.Warn("queue number > 8 may cause race condition, please use multiple interface instead",
+			p.logArgs("num_tx_queues", p.cfg.MemoryConfig.NumTxQueues, "num_rx_queues", p.cfg.MemoryConfig.NumRxQueues)...)
 	}
 	if p.cfg.MemoryConfig.Log2RingSize == 0 {
 		p.cfg.MemoryConfig.Log2RingSize = DefaultLog2RingSize
@@ -138,8 +177,11 @@ func (socket *Socket) NewPort(cfg *PortCfg) (*Port, error) {
 	if p.cfg.MemoryConfig.PacketBufferSize == 0 {
 		p.cfg.MemoryConfig.PacketBufferSize = DefaultPacketBufferSize
 	}
+	err = validateMemoryConfig(&p.cfg.MemoryConfig, &p.cfg.Layout)
+	if err != nil {
+		return nil, err
+	}
 
-	p.socket = socket
 	p.ExtendData = cfg.ExtendData
 
 	if p.cfg.DisconnectedFunc == nil {
@@ -149,9 +191,6 @@ func (socket *Socket) NewPort(cfg *PortCfg) (*Port, error) {
 	p.ErrChan = make(chan error, 1)
 	p.QuitChan = make(chan struct{}, 1)
 
-	// append port to the list
-	p.listRef = socket.portList.PushBack(&p)
-
 	if p.cfg.IsServer {
 		if socket.listener == nil {
 			err = socket.addListener()
@@ -161,65 +200,105 @@ func (socket *Socket) NewPort(cfg *PortCfg) (*Port, error) {
 		}
 	}
 
+	// register port
+	socket.ports[key] = &p
+
+	// resume port handed over by another process
+	if hp, ok := socket.handover[cfg.Id]; ok && p.cfg.IsServer {
+		delete(socket.handover, cfg.Id)
+		err = p.resume(hp)
+		if err != nil {
+			socket.logger.Warn("failed to resume port", p.logArgs("error", err)...)
+			socket.reportError(fmt.Errorf("failed to resume port %s: %w", p.cfg.Name, err))
+		}
+	}
+
 	return &p, nil
 }
 
-// addEvent adds event to epoll instance associated with the socket
-func (socket *Socket) addEvent(event *syscall.EpollEvent) error {
-	err := syscall.EpollCtl(socket.epfd, syscall.EPOLL_CTL_ADD, int(event.Fd), event)
-	if err != nil {
-		return fmt.Errorf("EpollCtl: %s", err)
-	}
-	return nil
+// addEvent adds event to the poller associated with the socket,
+// events are handled by h
+func (socket *Socket) addEvent(event *syscall.EpollEvent, h eventHandler) error {
+	return socket.poller.add(int(event.Fd), event.Events, func(event *syscall.EpollEvent) {
+		socket.dispatch(h, event)
+	})
 }
 
-// addEvent deletes event to epoll instance associated with the socket
+// delEvent deletes event from the poller associated with the socket
 func (socket *Socket) delEvent(event *syscall.EpollEvent) error {
-	err := syscall.EpollCtl(socket.epfd, syscall.EPOLL_CTL_DEL, int(event.Fd), event)
-	if err != nil {
-		return fmt.Errorf("EpollCtl: %s", err)
-	}
-	return nil
+	return socket.poller.del(int(event.Fd))
 }
 
-// Delete deletes the socket
+// Delete deletes the socket, see Close
 func (socket *Socket) Delete() (err error) {
-	for elt := socket.ccList.Front(); elt != nil; elt = elt.Next() {
-		cc, ok := elt.Value.(*controlChannel)
-		if ok {
-			err = cc.close(true, "Socket deleted")
-			if err != nil {
-				return nil
-			}
+	return socket.Close(context.Background())
+}
+
+// Close shuts the socket down. It stops polling, sends a disconnect to
+// every peer, waits for port workers (Port.Wg) to stop, unmaps shared
+// memory, closes all file descriptors and removes the socket file created
+// by the listener. ctx bounds the time spent waiting for port workers,
+// shared memory of ports whose workers did not stop in time is left
+// mapped. All errors are reported joined together. The socket can not be used afterwards.
+//
+// Close may be called from ConnectedFunc and DisconnectedFunc, which run
+// on the event loop. It doesn't wait for the loop then, the loop returns
+// once the callback returned.
+func (socket *Socket) Close(ctx context.Context) error {
+	var errs []error
+
+	// stop the event loop first, so that no handler runs during teardown
+	if socket.ownPoller {
+		err := socket.poller.Stop()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to stop poller: %v", err))
 		}
 	}
-	for elt := socket.portList.Front(); elt != nil; elt = elt.Next() {
-		i, ok := elt.Value.(*Port)
-		if ok {
-			err = i.Delete()
-			if err != nil {
-				return err
-			}
-		}
+
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+
+	if socket.closed {
+		return nil
 	}
+	socket.closed = true
 
 	if socket.listener != nil {
-		err = socket.listener.close()
+		err := socket.listener.close()
 		if err != nil {
-			return err
+			errs = append(errs, err)
+		}
+		socket.listener = nil
+		if socket.ownsFile {
+			err = os.Remove(socket.filename)
+			if err != nil && !os.IsNotExist(err) {
+				errs = append(errs, fmt.Errorf("failed to remove socket file: %v", err))
+			}
 		}
-		err = os.Remove(socket.filename)
+	}
+
+	for _, cc := range socket.ccs {
+		err := cc.closeContext(ctx, true, ErrShutdown)
 		if err != nil {
-			return nil
+			errs = append(errs, err)
 		}
 	}
 
-	err = socket.delEvent(&socket.wakeEvent)
-	if err != nil {
-		return fmt.Errorf("failed to delete event: %v", err)
+	for _, p := range socket.ports {
+		err := p.delete()
+		if err != nil {
+			errs = append(errs, err)
+		}
 	}
 
-	syscall.Close(socket.epfd)
+	socket.closeHandover()
+
+	if socket.ownPoller {
+		err := socket.poller.Close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to close poller: %v", err))
+		}
+	}
 
-	return nil
+	return errors.Join(errs...)
 }
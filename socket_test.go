@@ -0,0 +1,340 @@
+package zmemif
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitFor polls cond until it returns true or fails the test after a
+// few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// drainErrors discards errors reported by the socket until it is closed
+func drainErrors(socket *Socket) {
+	go func() {
+		for range socket.ErrChan {
+		}
+	}()
+}
+
+// closeSocket closes socket and fails the test on errors
+func closeSocket(t *testing.T, socket *Socket) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := socket.Close(ctx)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func nopConnected(p *Port) error { return nil }
+
+// TestPortsAddRemoveWhilePolling creates, connects and deletes ports from
+// several goroutines while both sockets are polling. Run with -race.
+func TestPortsAddRemoveWhilePolling(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "memif.sock")
+	srv, err := NewSocket("srv", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := NewSocket("cli", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(srv)
+	drainErrors(cli)
+	// keep the listener open while ports come and go
+	_, err = NewPort(srv, &PortCfg{Id: 1000, Name: "anchor", IsServer: true, ConnectedFunc: nopConnected}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.StartPolling()
+	cli.StartPolling()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				id := uint32(g*100 + i)
+				sp, err := NewPort(srv, &PortCfg{Id: id, Name: fmt.Sprint("s", id), IsServer: true, ConnectedFunc: nopConnected}, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				cp, err := NewPort(cli, &PortCfg{Id: id, Name: fmt.Sprint("c", id), ConnectedFunc: nopConnected}, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				deadline := time.Now().Add(5 * time.Second)
+				for !(sp.IsConnected() && cp.IsConnected()) && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+				if !sp.IsConnected() || !cp.IsConnected() {
+					t.Errorf("port %d not connected: %v", id, cp.DisconnectReason())
+				}
+				srv.ListPorts()
+				cp.Delete()
+				sp.Delete()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	closeSocket(t, cli)
+	closeSocket(t, srv)
+	if len(srv.ports) != 0 || len(srv.ccs) != 0 || len(cli.ports) != 0 || len(cli.ccs) != 0 {
+		t.Fatalf("registries not empty: %d %d %d %d", len(srv.ports), len(srv.ccs), len(cli.ports), len(cli.ccs))
+	}
+}
+
+// TestCallbacksCallSocket verifies that callbacks and port workers may
+// call Socket and Port methods while the port connects and disconnects
+func TestCallbacksCallSocket(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "memif.sock")
+	srv, err := NewSocket("srv", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := NewSocket("cli", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(srv)
+	drainErrors(cli)
+
+	// the worker deletes its port once it is told to stop
+	deleted := make(chan struct{})
+	_, err = NewPort(srv, &PortCfg{Id: 1, Name: "srv", IsServer: true, ConnectedFunc: func(p *Port) error {
+		p.GetSocket().ListPorts()
+		p.Wg.Add(1)
+		go func() {
+			defer p.Wg.Done()
+			<-p.QuitChan
+			p.Delete()
+			close(deleted)
+		}()
+		return nil
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.StartPolling()
+	cli.StartPolling()
+
+	cp, err := NewPort(cli, &PortCfg{Id: 1, Name: "cli", ConnectedFunc: nopConnected}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "client connected", cp.IsConnected)
+
+	err = cp.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-deleted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker blocked deleting its port")
+	}
+	listed := make(chan []PortInfo)
+	go func() { listed <- srv.ListPorts() }()
+	select {
+	case ports := <-listed:
+		if len(ports) != 0 {
+			t.Fatalf("port not deleted: %+v", ports)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("socket deadlocked")
+	}
+
+	// disconnecting from ConnectedFunc finishes once it returns
+	disconnected := make(chan struct{}, 1)
+	sp, err := NewPort(srv, &PortCfg{Id: 2, Name: "srv2", IsServer: true,
+		ConnectedFunc: func(p *Port) error {
+			return p.Disconnect()
+		},
+		DisconnectedFunc: func(p *Port) error {
+			disconnected <- struct{}{}
+			return nil
+		}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp, err = NewPort(cli, &PortCfg{Id: 2, Name: "cli2", ConnectedFunc: nopConnected}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("port not disconnected")
+	}
+	waitFor(t, "client disconnected", func() bool { return cp.DisconnectReason() != nil && !cp.IsConnected() })
+	waitFor(t, "server port released", func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return sp.cc == nil && sp.regions == nil && !sp.callback
+	})
+
+	closeSocket(t, cli)
+	closeSocket(t, srv)
+}
+
+// TestCloseFromCallbacks closes the socket and deletes the port from
+// callbacks running on the event loop, DisconnectedFunc is called for a
+// disconnect by the peer
+func TestCloseFromCallbacks(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		disconnected bool
+		close        bool
+	}{
+		{"Close in ConnectedFunc", false, true},
+		{"Close in DisconnectedFunc", true, true},
+		{"Delete in ConnectedFunc", false, false},
+		{"Delete in DisconnectedFunc", true, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "memif.sock")
+			srv, err := NewSocket("srv", file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cli, err := NewSocket("cli", file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			drainErrors(srv)
+			drainErrors(cli)
+			defer closeSocket(t, cli)
+
+			result := make(chan error, 1)
+			call := func(p *Port) error {
+				if tc.close {
+					result <- srv.Close(context.Background())
+				} else {
+					result <- p.Delete()
+				}
+				return nil
+			}
+			cfg := &PortCfg{Id: 0, Name: "srv", IsServer: true, ConnectedFunc: call}
+			if tc.disconnected {
+				cfg.ConnectedFunc = nopConnected
+				cfg.DisconnectedFunc = call
+			}
+			_, err = NewPort(srv, cfg, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			srv.StartPolling()
+			cli.StartPolling()
+			cp, err := NewPort(cli, &PortCfg{Id: 0, Name: "cli", ConnectedFunc: nopConnected}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.disconnected {
+				waitFor(t, "client connected", cp.IsConnected)
+				err = cp.Delete()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			select {
+			case err = <-result:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("deadlocked")
+			}
+			waitFor(t, "server port deleted", func() bool { return len(srv.ListPorts()) == 0 })
+			closeSocket(t, srv)
+		})
+	}
+}
+
+// countFds returns the number of fds open in the process
+func countFds(t *testing.T) int {
+	t.Helper()
+	ents, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(ents)
+}
+
+// TestCloseReleasesFds connects several port pairs with workers and
+// checks that closing both sockets closes every fd they opened
+func TestCloseReleasesFds(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "memif.sock")
+	base := countFds(t)
+
+	srv, err := NewSocket("srv", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := NewSocket("cli", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(srv)
+	drainErrors(cli)
+	worker := func(p *Port) error {
+		p.Wg.Add(1)
+		go func() {
+			defer p.Wg.Done()
+			<-p.QuitChan
+		}()
+		return nil
+	}
+	var cps []*Port
+	for id := uint32(0); id < 4; id++ {
+		mc := MemoryConfig{NumQueuePairs: 2}
+		_, err = NewPort(srv, &PortCfg{Id: id, Name: fmt.Sprint("s", id), IsServer: true, ConnectedFunc: worker, MemoryConfig: mc}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cp, err := NewPort(cli, &PortCfg{Id: id, Name: fmt.Sprint("c", id), ConnectedFunc: worker, MemoryConfig: mc}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cps = append(cps, cp)
+	}
+	srv.StartPolling()
+	cli.StartPolling()
+	for _, cp := range cps {
+		waitFor(t, "client connected", cp.IsConnected)
+	}
+	if countFds(t) <= base {
+		t.Fatal("connected ports opened no fds")
+	}
+
+	closeSocket(t, srv)
+	closeSocket(t, cli)
+	if n := countFds(t); n > base {
+		t.Fatalf("%d fds open after Close, %d before NewSocket", n, base)
+	}
+	_, err = os.Stat(file)
+	if !os.IsNotExist(err) {
+		t.Fatalf("socket file not removed: %v", err)
+	}
+}
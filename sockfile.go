@@ -0,0 +1,111 @@
+package zmemif
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// socketFileCfg describes how the listener creates its socket file
+type socketFileCfg struct {
+	mode        os.FileMode
+	setMode     bool
+	uid         int
+	gid         int
+	createDir   bool
+	dirPerm     os.FileMode
+	removeStale bool
+}
+
+// isAbstract returns true if filename names a socket in the Linux
+// abstract namespace. Such names start with '@' and have no file.
+func isAbstract(filename string) bool {
+	return strings.HasPrefix(filename, "@")
+}
+
+// prepareSocketFile creates the parent directory and removes a stale
+// socket file before the listener binds to it
+func (socket *Socket) prepareSocketFile() error {
+	if isAbstract(socket.filename) {
+		return nil
+	}
+
+	if socket.fileCfg.createDir {
+		err := os.MkdirAll(filepath.Dir(socket.filename), socket.fileCfg.dirPerm)
+		if err != nil {
+			return fmt.Errorf("failed to create socket directory: %v", err)
+		}
+	}
+
+	if socket.fileCfg.removeStale {
+		err := removeStaleSocket(socket.filename)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applySocketFileCfg sets permissions and ownership of the socket file.
+// It is called after bind and before listen, so no peer can connect
+// before the permissions are in place.
+func (socket *Socket) applySocketFileCfg() error {
+	if isAbstract(socket.filename) {
+		return nil
+	}
+
+	if socket.fileCfg.setMode {
+		err := os.Chmod(socket.filename, socket.fileCfg.mode)
+		if err != nil {
+			return fmt.Errorf("failed to set socket file mode: %v", err)
+		}
+	}
+
+	if socket.fileCfg.uid != -1 || socket.fileCfg.gid != -1 {
+		err := os.Lchown(socket.filename, socket.fileCfg.uid, socket.fileCfg.gid)
+		if err != nil {
+			return fmt.Errorf("failed to set socket file owner: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// removeStaleSocket removes the socket file left behind by a process that
+// is no longer listening on it. Files that are not sockets and sockets
+// accepting connections are left in place.
+func removeStaleSocket(filename string) error {
+	fi, err := os.Lstat(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", filename)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to create UNIX domain socket: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	err = syscall.Connect(fd, &syscall.SockaddrUnix{Name: filename})
+	if err == nil {
+		return fmt.Errorf("socket %s is in use", filename)
+	}
+	if err != syscall.ECONNREFUSED {
+		return fmt.Errorf("failed to probe socket %s : %v", filename, err)
+	}
+
+	err = os.Remove(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package zmemif
+
+import (
+	"fmt"
+	"time"
+)
+
+// default handshake timeouts used by sockets without
+// WithHandshakeTimeouts
+const (
+	defaultPhaseTimeout     = 5 * time.Second
+	defaultHandshakeTimeout = 15 * time.Second
+)
+
+// HandshakeTimeouts bounds the time a peer may take to complete the memif
+// handshake. A control channel that doesn't progress in time is closed
+// with DisconnectCodeHandshakeTimeout, freeing its fds and any memory
+// regions received so far. Zero values select the defaults: 5 seconds
+// for each phase and 15 seconds in total. Negative values disable a
+// timeout.
+type HandshakeTimeouts struct {
+	Hello   time.Duration // client: connection to MsgHello
+	Init    time.Duration // server: connection to MsgInit
+	Connect time.Duration // server: MsgInit to MsgConnect, client: MsgHello to MsgConnected
+	Total   time.Duration // connection to connected
+}
+
+func timeoutOrDefault(d time.Duration, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
+
+func (t *HandshakeTimeouts) hello() time.Duration {
+	return timeoutOrDefault(t.Hello, defaultPhaseTimeout)
+}
+
+func (t *HandshakeTimeouts) init() time.Duration {
+	return timeoutOrDefault(t.Init, defaultPhaseTimeout)
+}
+
+func (t *HandshakeTimeouts) connect() time.Duration {
+	return timeoutOrDefault(t.Connect, defaultPhaseTimeout)
+}
+
+func (t *HandshakeTimeouts) total() time.Duration {
+	return timeoutOrDefault(t.Total, defaultHandshakeTimeout)
+}
+
+// startHandshake arms the handshake timers of a new control channel,
+// socket lock must be held
+func (cc *controlChannel) startHandshake() {
+	t := &cc.socket.handshakeTimeouts
+
+	if d := t.total(); d > 0 {
+		cc.handshakeTimer = time.AfterFunc(d, func() {
+			cc.expire(0, fmt.Sprintf("not connected after %s", d))
+		})
+	}
+	if cc.port == nil {
+		cc.setPhase(msgTypeInit, t.init())
+	} else {
+		cc.setPhase(msgTypeHello, t.hello())
+	}
+}
+
+// setPhase makes the control channel wait for a message of type msg for
+// at most timeout, socket lock must be held
+func (cc *controlChannel) setPhase(msg msgType, timeout time.Duration) {
+	if cc.phaseTimer != nil {
+		cc.phaseTimer.Stop()
+		cc.phaseTimer = nil
+	}
+	cc.phase++
+	if timeout <= 0 {
+		return
+	}
+
+	phase := cc.phase
+	cc.phaseTimer = time.AfterFunc(timeout, func() {
+		cc.expire(phase, fmt.Sprintf("waiting for %s", msg))
+	})
+}
+
+// stopHandshake stops the handshake timers, socket lock must be held
+func (cc *controlChannel) stopHandshake() {
+	if cc.handshakeTimer != nil {
+		cc.handshakeTimer.Stop()
+		cc.handshakeTimer = nil
+	}
+	if cc.phaseTimer != nil {
+		cc.phaseTimer.Stop()
+		cc.phaseTimer = nil
+	}
+	cc.phase++
+}
+
+// expire closes the control channel if the handshake hasn't completed,
+// or with a non-zero phase if it hasn't progressed past phase. The timers
+// run on their own goroutines, so a timer may fire after the handshake
+// progressed.
+func (cc *controlChannel) expire(phase uint64, what string) {
+	socket := cc.socket
+	socket.mu.Lock()
+	defer socket.mu.Unlock()
+
+	if socket.closed || cc.closed || cc.isConnected || (phase != 0 && cc.phase != phase) {
+		return
+	}
+
+	reason := fmt.Errorf("%w: %s", ErrHandshakeTimeout, what)
+	socket.logger.Warn("handshake timed out", cc.logArgs("error", reason)...)
+	err := cc.close(true, reason)
+	if err != nil {
+		socket.reportError(fmt.Errorf("failed to close control channel %s: %w", cc.name(), err))
+	}
+}
@@ -0,0 +1,171 @@
+package zmemif
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/zartbot/zmemif/controlmsg"
+)
+
+// expectTimeout waits for the disconnect of a stalled raw peer and checks
+// that it reports a handshake timeout matching what
+func expectTimeout(t *testing.T, r *rawPeer, what string) {
+	t.Helper()
+	err := syscall.SetsockoptTimeval(r.fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &syscall.Timeval{Sec: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := r.expect(controlmsg.TypeDisconnect).(*controlmsg.Disconnect)
+	reason := controlmsg.String(dc.String[:])
+	if DisconnectCode(dc.Code) != DisconnectCodeHandshakeTimeout || !strings.Contains(reason, what) {
+		t.Fatalf("disconnect %s %q, want %s %q", DisconnectCode(dc.Code), reason, DisconnectCodeHandshakeTimeout, what)
+	}
+}
+
+// stalledServer returns the socket file of a polling server socket with
+// the given timeouts and its port
+func stalledServer(t *testing.T, timeouts HandshakeTimeouts) (string, *Socket, *Port) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "memif.sock")
+	srv, err := NewSocket("srv", file, WithHandshakeTimeouts(timeouts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(srv)
+	t.Cleanup(func() { closeSocket(t, srv) })
+	sp, err := NewPort(srv, &PortCfg{Id: 0, Name: "srv", IsServer: true, ConnectedFunc: nopConnected}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.StartPolling()
+	return file, srv, sp
+}
+
+func TestHandshakeTimeoutInit(t *testing.T) {
+	file, _, _ := stalledServer(t, HandshakeTimeouts{Init: 50 * time.Millisecond, Total: -1})
+
+	// the peer connects but never sends Init
+	r := dialRaw(t, file)
+	expectTimeout(t, r, "waiting for Init")
+}
+
+func TestHandshakeTimeoutConnect(t *testing.T) {
+	file, srv, sp := stalledServer(t, HandshakeTimeouts{Connect: 50 * time.Millisecond, Total: -1})
+	fd, _ := sharedMemory(t, 4096)
+	base := countFds(t)
+
+	// the peer adds a region and a ring, but never sends Connect
+	r := dialRaw(t, file)
+	r.send(&controlmsg.Init{Version: controlmsg.Version}, -1)
+	r.expect(controlmsg.TypeAck)
+	r.send(&controlmsg.AddRegion{Size: 4096}, fd)
+	r.expect(controlmsg.TypeAck)
+	efd, err := eventFd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.send(&controlmsg.AddRing{RingSizeLog2: 4}, efd)
+	syscall.Close(efd)
+	r.expect(controlmsg.TypeAck)
+	expectTimeout(t, r, "waiting for Connect")
+
+	waitFor(t, "port released", func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return sp.cc == nil && sp.regions == nil && len(sp.txQueues) == 0
+	})
+	if !errors.Is(sp.DisconnectReason(), ErrHandshakeTimeout) {
+		t.Fatalf("disconnect reason %v", sp.DisconnectReason())
+	}
+	// the server closed the channel, the region fd and the eventfd
+	r.close()
+	waitFor(t, "fds closed", func() bool { return countFds(t) <= base })
+}
+
+func TestHandshakeTimeoutTotal(t *testing.T) {
+	file, _, _ := stalledServer(t, HandshakeTimeouts{Connect: -1, Total: 100 * time.Millisecond})
+
+	// the peer sends Init in time, but never completes the handshake
+	r := dialRaw(t, file)
+	r.send(&controlmsg.Init{Version: controlmsg.Version}, -1)
+	r.expect(controlmsg.TypeAck)
+	expectTimeout(t, r, "not connected after")
+}
+
+func TestHandshakeTimeoutHello(t *testing.T) {
+	// the server accepts the connection but never sends Hello
+	file := filepath.Join(t.TempDir(), "memif.sock")
+	lfd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(lfd)
+	err = syscall.Bind(lfd, &syscall.SockaddrUnix{Name: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syscall.Listen(lfd, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cli, err := NewSocket("cli", file, WithHandshakeTimeouts(HandshakeTimeouts{Hello: 50 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(cli)
+	defer closeSocket(t, cli)
+	cp, err := NewPort(cli, &PortCfg{Id: 0, Name: "cli", ConnectedFunc: nopConnected}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.StartPolling()
+	waitFor(t, "client timed out", func() bool { return cp.DisconnectReason() != nil })
+	if !errors.Is(cp.DisconnectReason(), ErrHandshakeTimeout) || cp.IsConnected() {
+		t.Fatalf("disconnect reason %v", cp.DisconnectReason())
+	}
+}
+
+// TestHandshakeTimeoutsConnected checks that expired timers don't
+// disconnect connected ports
+func TestHandshakeTimeoutsConnected(t *testing.T) {
+	timeouts := WithHandshakeTimeouts(HandshakeTimeouts{
+		Hello:   20 * time.Millisecond,
+		Init:    20 * time.Millisecond,
+		Connect: 20 * time.Millisecond,
+		Total:   40 * time.Millisecond,
+	})
+	file := filepath.Join(t.TempDir(), "memif.sock")
+	srv, err := NewSocket("srv", file, timeouts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err := NewSocket("cli", file, timeouts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(srv)
+	drainErrors(cli)
+	sp, err := NewPort(srv, &PortCfg{Id: 0, Name: "srv", IsServer: true, ConnectedFunc: nopConnected}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.StartPolling()
+	cp, err := NewPort(cli, &PortCfg{Id: 0, Name: "cli", ConnectedFunc: nopConnected}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.StartPolling()
+	waitFor(t, "ports connected", func() bool { return sp.IsConnected() && cp.IsConnected() })
+
+	time.Sleep(100 * time.Millisecond)
+	if !sp.IsConnected() || !cp.IsConnected() {
+		t.Fatalf("disconnected: %v %v", sp.DisconnectReason(), cp.DisconnectReason())
+	}
+	closeSocket(t, cli)
+	closeSocket(t, srv)
+}
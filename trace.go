@@ -0,0 +1,269 @@
+package zmemif
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/zartbot/zmemif/controlmsg"
+)
+
+// TraceDirection tells whether a traced control message was sent or
+// received
+type TraceDirection int
+
+const (
+	TraceSent TraceDirection = iota
+	TraceReceived
+)
+
+func (d TraceDirection) String() string {
+	switch d {
+	case TraceSent:
+		return "sent"
+	case TraceReceived:
+		return "received"
+	}
+	return "unknown"
+}
+
+// TraceRecord describes a control message sent or received by a socket,
+// see WithTraceFunc. The secret carried by MsgInit is cleared.
+//
+// A received message that fails to decode is traced with a nil Msg, its
+// raw bytes in Data and the decode error in Err.
+type TraceRecord struct {
+	Time      time.Time
+	Direction TraceDirection
+	Socket    string // socket filename
+	Channel   int    // control channel fd, identifies the connection
+	PortId    uint32 // zero if no port is assigned to the peer yet
+	PortName  string // empty if no port is assigned to the peer yet
+	Type      controlmsg.Type
+	Msg       controlmsg.Message
+	Fd        int    // fd attached to the message, -1 if none
+	Data      []byte // message as received, only set if Msg is nil
+	Err       error  // decode error, only set if Msg is nil
+}
+
+// TraceFunc receives every control message decoded or sent by a socket.
+// It is called with the socket locked, like EventFunc.
+type TraceFunc func(rec TraceRecord)
+
+// initSecretOffset is the offset of the secret in an encoded Init
+// message: type, version, id and mode precede it
+const initSecretOffset = controlmsg.TypeSize + 2 + 4 + 1
+
+// trace passes a control message to the sockets TraceFunc, socket lock
+// must be held
+func (cc *controlChannel) trace(dir TraceDirection, msg controlmsg.Message, fd int) {
+	if cc.socket.traceFunc == nil {
+		return
+	}
+
+	if init, ok := msg.(*MsgInit); ok {
+		redacted := *init
+		redacted.Secret = [24]byte{}
+		msg = &redacted
+	}
+	rec := cc.traceRecord(dir)
+	rec.Type = msg.Type()
+	rec.Msg = msg
+	rec.Fd = fd
+	cc.socket.traceFunc(rec)
+}
+
+// traceInvalid passes a received message that failed to decode to the
+// sockets TraceFunc, socket lock must be held. Fds received with the
+// message are closed by the decoder.
+func (cc *controlChannel) traceInvalid(data []byte, err error) {
+	if cc.socket.traceFunc == nil {
+		return
+	}
+
+	rec := cc.traceRecord(TraceReceived)
+	rec.Fd = -1
+	rec.Data = append([]byte(nil), data...)
+	rec.Err = err
+	if len(data) >= controlmsg.TypeSize {
+		rec.Type = controlmsg.Type(binary.LittleEndian.Uint16(data))
+	}
+	if rec.Type == controlmsg.TypeInit && len(rec.Data) > initSecretOffset {
+		secret := rec.Data[initSecretOffset:min(len(rec.Data), initSecretOffset+24)]
+		clear(secret)
+	}
+	cc.socket.traceFunc(rec)
+}
+
+// traceRecord returns a record of the control channel without message
+func (cc *controlChannel) traceRecord(dir TraceDirection) TraceRecord {
+	rec := TraceRecord{
+		Time:      time.Now(),
+		Direction: dir,
+		Socket:    cc.socket.filename,
+		Channel:   int(cc.event.Fd),
+	}
+	if cc.port != nil {
+		rec.PortId = cc.port.cfg.Id
+		rec.PortName = cc.port.cfg.Name
+	}
+	return rec
+}
+
+// Fields returns the fields of the traced message by name. Names held in
+// byte arrays are returned as strings, the secret of MsgInit is omitted.
+func (rec *TraceRecord) Fields() map[string]interface{} {
+	fields := make(map[string]interface{})
+	if rec.Msg == nil {
+		return fields
+	}
+	v := reflect.ValueOf(rec.Msg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		f := v.Field(i)
+		if name == "Secret" {
+			// cleared by trace
+			continue
+		}
+		if f.Kind() == reflect.Array && f.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, f.Len())
+			reflect.Copy(reflect.ValueOf(b), f)
+			fields[name] = controlmsg.String(b)
+			continue
+		}
+		fields[name] = f.Interface()
+	}
+	return fields
+}
+
+// jsonTraceRecord is the JSON representation of a TraceRecord. Data
+// holds the encoded message, so that it can be decoded again, or the
+// bytes received if the message failed to decode with Error.
+type jsonTraceRecord struct {
+	Time      time.Time              `json:"time"`
+	Direction string                 `json:"direction"`
+	Socket    string                 `json:"socket"`
+	Channel   int                    `json:"channel"`
+	PortId    uint32                 `json:"port_id"`
+	PortName  string                 `json:"port_name,omitempty"`
+	Type      string                 `json:"type"`
+	Fields    map[string]interface{} `json:"fields"`
+	Fd        int                    `json:"fd"`
+	Data      []byte                 `json:"data"`
+	Error     string                 `json:"error,omitempty"`
+}
+
+// MarshalJSON encodes the record as written by NewJSONTracer
+func (rec TraceRecord) MarshalJSON() ([]byte, error) {
+	var data []byte
+	var errStr string
+	if rec.Msg == nil {
+		if rec.Err == nil {
+			return nil, fmt.Errorf("trace record without message")
+		}
+		data = rec.Data
+		errStr = rec.Err.Error()
+	} else {
+		var err error
+		data, err = controlmsg.Marshal(rec.Msg)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(jsonTraceRecord{
+		Time:      rec.Time,
+		Direction: rec.Direction.String(),
+		Socket:    rec.Socket,
+		Channel:   rec.Channel,
+		PortId:    rec.PortId,
+		PortName:  rec.PortName,
+		Type:      rec.Type.String(),
+		Fields:    rec.Fields(),
+		Fd:        rec.Fd,
+		Data:      data,
+		Error:     errStr,
+	})
+}
+
+// UnmarshalJSON decodes a record written by NewJSONTracer, the message
+// is decoded from its recorded wire representation. Records of messages
+// that failed to decode keep their bytes in Data, Err holds the error
+// text.
+func (rec *TraceRecord) UnmarshalJSON(b []byte) error {
+	var jr jsonTraceRecord
+	err := json.Unmarshal(b, &jr)
+	if err != nil {
+		return err
+	}
+
+	*rec = TraceRecord{
+		Time:      jr.Time,
+		Direction: TraceSent,
+		Socket:    jr.Socket,
+		Channel:   jr.Channel,
+		PortId:    jr.PortId,
+		PortName:  jr.PortName,
+		Fd:        jr.Fd,
+	}
+	if jr.Error != "" {
+		rec.Data = jr.Data
+		rec.Err = errors.New(jr.Error)
+		if len(jr.Data) >= controlmsg.TypeSize {
+			rec.Type = controlmsg.Type(binary.LittleEndian.Uint16(jr.Data))
+		}
+	} else {
+		msg, err := controlmsg.Unmarshal(jr.Data)
+		if err != nil {
+			return fmt.Errorf("trace record message: %w", err)
+		}
+		rec.Type = msg.Type()
+		rec.Msg = msg
+	}
+	if jr.Direction == TraceReceived.String() {
+		rec.Direction = TraceReceived
+	}
+	return nil
+}
+
+// NewLogTracer returns a TraceFunc logging every control message to l at
+// debug level
+func NewLogTracer(l Logger) TraceFunc {
+	return func(rec TraceRecord) {
+		args := []interface{}{
+			"socket", rec.Socket,
+			"channel", rec.Channel,
+			"port_id", rec.PortId,
+			"port_name", rec.PortName,
+			"direction", rec.Direction,
+			"msg_type", rec.Type,
+			"fields", rec.Fields(),
+			"fd", rec.Fd,
+		}
+		if rec.Err != nil {
+			args = append(args, "data", fmt.Sprintf("%x", rec.Data), "error", rec.Err)
+		}
+		l.Debug("control message", args...)
+	}
+}
+
+// NewJSONTracer returns a TraceFunc writing every control message to w
+// as a line of JSON. The lines can be read back into TraceRecords with
+// encoding/json, for example to replay a handshake. Write errors are
+// ignored.
+func NewJSONTracer(w io.Writer) TraceFunc {
+	var mu sync.Mutex
+	return func(rec TraceRecord) {
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		w.Write(append(b, '\n'))
+		mu.Unlock()
+	}
+}
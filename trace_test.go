@@ -0,0 +1,78 @@
+package zmemif
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/zartbot/zmemif/controlmsg"
+)
+
+// TestTraceDecodeError sends an Init that fails to decode, it must be
+// traced with its bytes, the secret cleared, and the decode error
+func TestTraceDecodeError(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "memif.sock")
+	records := make(chan TraceRecord, 16)
+	srv, err := NewSocket("srv", file, WithTraceFunc(func(rec TraceRecord) { records <- rec }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drainErrors(srv)
+	defer closeSocket(t, srv)
+	_, err = NewPort(srv, &PortCfg{Id: 0, Name: "srv", IsServer: true, ConnectedFunc: nopConnected}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.StartPolling()
+
+	r := dialRaw(t, file)
+	init := make([]byte, controlmsg.Size)
+	init[0] = byte(controlmsg.TypeInit)
+	init[2] = controlmsg.Version & 0xff
+	init[3] = controlmsg.Version >> 8
+	init[8] = 0x7f // mode
+	copy(init[initSecretOffset:], "hunter2")
+	err = syscall.Sendmsg(r.fd, init, nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.expect(controlmsg.TypeDisconnect)
+
+	var rec TraceRecord
+	for rec.Direction != TraceReceived {
+		select {
+		case rec = <-records:
+		case <-time.After(5 * time.Second):
+			t.Fatal("decode error not traced")
+		}
+	}
+	if rec.Msg != nil || rec.Type != controlmsg.TypeInit || rec.Fd != -1 {
+		t.Fatalf("record %+v", rec)
+	}
+	if !errors.Is(rec.Err, controlmsg.ErrInvalidField) {
+		t.Fatalf("error %v", rec.Err)
+	}
+	want := append([]byte(nil), init...)
+	clear(want[initSecretOffset : initSecretOffset+24])
+	if !bytes.Equal(rec.Data, want) {
+		t.Fatalf("data\n%x\nwant\n%x", rec.Data, want)
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded TraceRecord
+	err = json.Unmarshal(b, &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Msg != nil || decoded.Type != controlmsg.TypeInit || decoded.Direction != TraceReceived ||
+		!bytes.Equal(decoded.Data, want) || decoded.Err == nil || decoded.Err.Error() != rec.Err.Error() {
+		t.Fatalf("decoded %+v", decoded)
+	}
+}
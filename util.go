@@ -1,7 +1,9 @@
 package zmemif
 
 import (
+	"context"
 	"os"
+	"sync"
 	"syscall"
 )
 
@@ -19,6 +21,15 @@ func min8(a uint8, b uint8) uint8 {
 	return b
 }
 
+// ringCount returns the number of rings allowed by the highest ring
+// index advertised in MsgHello
+func ringCount(maxIndex uint16) uint16 {
+	if maxIndex == 0xffff {
+		return maxIndex
+	}
+	return maxIndex + 1
+}
+
 // eventFd returns an eventfd (SYS_EVENTFD2)
 func eventFd() (efd int, err error) {
 	u_efd, _, errno := syscall.Syscall(syscall.SYS_EVENTFD2, uintptr(0), uintptr(efd_nonblock), 0)
@@ -27,3 +38,19 @@ func eventFd() (efd int, err error) {
 	}
 	return int(u_efd), nil
 }
+
+// waitContext waits for wg until ctx expires
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}